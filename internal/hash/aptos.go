@@ -0,0 +1,100 @@
+package hash
+
+import "crypto/sha3"
+
+// AptosEngine은 Aptos sparse Merkle tree와 같은 해시를 쓰는 백엔드라서 root와
+// sparse proof를 Aptos 검증기가 그대로 받는다. aptos-crypto의 DefaultHasher처럼
+// 타입 이름에서 seed를 만들고, key를 쓰지 않는다.
+//
+//   - seed_T = SHA3-256("APTOS::" || T)
+//   - leaf   = SHA3-256(seed_SparseMerkleLeafNode || leafKey || valueHash)
+//   - parent = SHA3-256(seed_SparseMerkleInternal || left || right)
+//   - zero   = 모든 depth에서 SPARSE_MERKLE_PLACEHOLDER_HASH (0으로 채운 ASCII).
+//   - key, value = key 없는 SchemeSHA3와 같다. Aptos는 state key와 value를 자기
+//     타입으로 해시하므로 Aptos 상태는 그 32바이트 해시를 Key와 Value로 넘긴다.
+type AptosEngine struct {
+	counters
+	leafSeed   [32]byte
+	parentSeed [32]byte
+	keySalt    [32]byte
+	valueSalt  [32]byte
+}
+
+// AptosPlaceholderHash is Aptos's SPARSE_MERKLE_PLACEHOLDER_HASH, the hash
+// of an empty subtree at any depth.
+var AptosPlaceholderHash = [32]byte{
+	'S', 'P', 'A', 'R', 'S', 'E', '_', 'M', 'E', 'R', 'K', 'L', 'E', '_',
+	'P', 'L', 'A', 'C', 'E', 'H', 'O', 'L', 'D', 'E', 'R', '_', 'H', 'A', 'S', 'H',
+}
+
+func NewAptosEngine() *AptosEngine {
+	return &AptosEngine{
+		leafSeed:   aptosSeed("SparseMerkleLeafNode"),
+		parentSeed: aptosSeed("SparseMerkleInternal"),
+		keySalt:    sha3Salt("Key", [32]byte{}),
+		valueSalt:  sha3Salt("Value", [32]byte{}),
+	}
+}
+
+func aptosSeed(typeName string) [32]byte {
+	return sha3.Sum256([]byte("APTOS::" + typeName))
+}
+
+func (e *AptosEngine) Scheme() Scheme {
+	return SchemeAptos
+}
+
+func (e *AptosEngine) ZeroHash(depth uint16) [32]byte {
+	return AptosPlaceholderHash
+}
+
+func (e *AptosEngine) HashLeaf(key [32]byte, value [32]byte) [32]byte {
+	e.leafScalarCalls.Add(1)
+	var payload [96]byte
+	copy(payload[:32], e.leafSeed[:])
+	copy(payload[32:64], key[:])
+	copy(payload[64:], value[:])
+	return sha3.Sum256(payload[:])
+}
+
+func (e *AptosEngine) HashKey(key []byte) [32]byte {
+	return sumSalted(&e.keySalt, key)
+}
+
+func (e *AptosEngine) HashValue(value []byte) [32]byte {
+	return sumSalted(&e.valueSalt, value)
+}
+
+func (e *AptosEngine) HashParent(left [32]byte, right [32]byte) [32]byte {
+	e.parentScalarCalls.Add(1)
+	return e.hashParentNoStats(left, right)
+}
+
+func (e *AptosEngine) hashParentNoStats(left [32]byte, right [32]byte) [32]byte {
+	var payload [96]byte
+	copy(payload[:32], e.parentSeed[:])
+	copy(payload[32:64], left[:])
+	copy(payload[64:], right[:])
+	return sha3.Sum256(payload[:])
+}
+
+func (e *AptosEngine) CompressParentsX4(out *[4][32]byte, pairs *[4]ParentPair) {
+	e.countBatch(4)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *AptosEngine) CompressParentsX8(out *[8][32]byte, pairs *[8]ParentPair) {
+	e.countBatch(8)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *AptosEngine) CompressParentsX16(out *[16][32]byte, pairs *[16]ParentPair) {
+	e.countBatch(16)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *AptosEngine) compressLanes(out [][32]byte, pairs []ParentPair) {
+	for i := range pairs {
+		out[i] = e.hashParentNoStats(pairs[i].Left, pairs[i].Right)
+	}
+}
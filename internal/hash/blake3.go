@@ -0,0 +1,237 @@
+package hash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BLAKE3 domain flags (spec §2.1).
+const (
+	flagChunkStart uint32 = 1 << iota
+	flagChunkEnd
+	flagParent
+	flagRoot
+	flagKeyedHash
+	flagDeriveKeyContext
+	flagDeriveKeyMaterial
+)
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+	// 2^54 chunks * 1KiB = 2^64 bytes, BLAKE3의 최대 입력 길이.
+	blake3MaxStackDepth = 54
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+// blake3Schedule는 라운드별 메시지 워드 순서다.
+// 라운드 r+1은 라운드 r에 permutation {2,6,3,10,7,0,4,13,1,11,12,5,9,14,15,8}을 적용한 결과다.
+var blake3Schedule = [7][16]uint8{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8},
+	{3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1},
+	{10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6},
+	{12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4},
+	{9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7},
+	{11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13},
+}
+
+//go:inline
+func blake3G(a, b, c, d, mx, my uint32) (uint32, uint32, uint32, uint32) {
+	a += b + mx
+	d = bits.RotateLeft32(d^a, -16)
+	c += d
+	b = bits.RotateLeft32(b^c, -12)
+	a += b + my
+	d = bits.RotateLeft32(d^a, -8)
+	c += d
+	b = bits.RotateLeft32(b^c, -7)
+	return a, b, c, d
+}
+
+// blake3Compress is the BLAKE3 compression function. It returns the full
+// 16-word state; the first 8 words are the chaining value.
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [16]uint32 {
+	s0, s1, s2, s3 := cv[0], cv[1], cv[2], cv[3]
+	s4, s5, s6, s7 := cv[4], cv[5], cv[6], cv[7]
+	s8, s9, s10, s11 := blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3]
+	s12, s13, s14, s15 := uint32(counter), uint32(counter>>32), blockLen, flags
+
+	for r := range blake3Schedule {
+		m := &blake3Schedule[r]
+		s0, s4, s8, s12 = blake3G(s0, s4, s8, s12, block[m[0]], block[m[1]])
+		s1, s5, s9, s13 = blake3G(s1, s5, s9, s13, block[m[2]], block[m[3]])
+		s2, s6, s10, s14 = blake3G(s2, s6, s10, s14, block[m[4]], block[m[5]])
+		s3, s7, s11, s15 = blake3G(s3, s7, s11, s15, block[m[6]], block[m[7]])
+		s0, s5, s10, s15 = blake3G(s0, s5, s10, s15, block[m[8]], block[m[9]])
+		s1, s6, s11, s12 = blake3G(s1, s6, s11, s12, block[m[10]], block[m[11]])
+		s2, s7, s8, s13 = blake3G(s2, s7, s8, s13, block[m[12]], block[m[13]])
+		s3, s4, s9, s14 = blake3G(s3, s4, s9, s14, block[m[14]], block[m[15]])
+	}
+
+	return [16]uint32{
+		s0 ^ s8, s1 ^ s9, s2 ^ s10, s3 ^ s11,
+		s4 ^ s12, s5 ^ s13, s6 ^ s14, s7 ^ s15,
+		s8 ^ cv[0], s9 ^ cv[1], s10 ^ cv[2], s11 ^ cv[3],
+		s12 ^ cv[4], s13 ^ cv[5], s14 ^ cv[6], s15 ^ cv[7],
+	}
+}
+
+//go:inline
+func blake3ChainingValue(state *[16]uint32) [8]uint32 {
+	return [8]uint32{state[0], state[1], state[2], state[3], state[4], state[5], state[6], state[7]}
+}
+
+func loadBlock(block *[16]uint32, src []byte) {
+	var buf [blake3BlockLen]byte
+	copy(buf[:], src)
+	for i := range block {
+		block[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+}
+
+//go:inline
+func loadPair(block *[16]uint32, left *[32]byte, right *[32]byte) {
+	for i := 0; i < 8; i++ {
+		block[i] = binary.LittleEndian.Uint32(left[i*4:])
+		block[i+8] = binary.LittleEndian.Uint32(right[i*4:])
+	}
+}
+
+//go:inline
+func loadKeyWords(key *[32]byte) [8]uint32 {
+	var words [8]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return words
+}
+
+//go:inline
+func storeWords(out *[32]byte, words *[8]uint32) {
+	for i := range words {
+		binary.LittleEndian.PutUint32(out[i*4:], words[i])
+	}
+}
+
+// blake3Output는 아직 압축되지 않은 마지막 노드(청크 또는 부모)를 보관한다.
+// 루트이면 ROOT 플래그를 붙여 XOF 출력을, 아니면 chaining value를 만든다.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() [8]uint32 {
+	state := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	return blake3ChainingValue(&state)
+}
+
+func (o *blake3Output) rootBytes(out []byte) {
+	var buf [blake3BlockLen]byte
+	for t := uint64(0); len(out) > 0; t++ {
+		state := blake3Compress(&o.cv, &o.block, t, o.blockLen, o.flags|flagRoot)
+		for i := range state {
+			binary.LittleEndian.PutUint32(buf[i*4:], state[i])
+		}
+		out = out[copy(out, buf[:]):]
+	}
+}
+
+// chunkOutput는 최대 1KiB 청크를 블록 단위로 압축하고 마지막 블록은 출력 노드로 남긴다.
+func chunkOutput(key *[8]uint32, chunk []byte, chunkCounter uint64, flags uint32) blake3Output {
+	cv := *key
+	blockFlags := flags | flagChunkStart
+	for len(chunk) > blake3BlockLen {
+		var block [16]uint32
+		loadBlock(&block, chunk[:blake3BlockLen])
+		state := blake3Compress(&cv, &block, chunkCounter, blake3BlockLen, blockFlags)
+		cv = blake3ChainingValue(&state)
+		chunk = chunk[blake3BlockLen:]
+		blockFlags = flags
+	}
+	out := blake3Output{
+		cv:       cv,
+		counter:  chunkCounter,
+		blockLen: uint32(len(chunk)),
+		flags:    blockFlags | flagChunkEnd,
+	}
+	loadBlock(&out.block, chunk)
+	return out
+}
+
+func parentOutput(key *[8]uint32, left *[8]uint32, right *[8]uint32, flags uint32) blake3Output {
+	out := blake3Output{
+		cv:       *key,
+		blockLen: blake3BlockLen,
+		flags:    flags | flagParent,
+	}
+	copy(out.block[:8], left[:])
+	copy(out.block[8:], right[:])
+	return out
+}
+
+// blake3Sum hashes data in BLAKE3 chunk/parent tree mode and fills out with
+// the root output (extendable). key is the IV for plain hashing or the key
+// words for keyed hashing; flags carries the mode flag.
+func blake3Sum(out []byte, key *[8]uint32, flags uint32, data []byte) {
+	var stack [blake3MaxStackDepth][8]uint32
+	depth := 0
+
+	var chunkCounter uint64
+	for len(data) > blake3ChunkLen {
+		chunk := chunkOutput(key, data[:blake3ChunkLen], chunkCounter, flags)
+		cv := chunk.chainingValue()
+		data = data[blake3ChunkLen:]
+		chunkCounter++
+
+		// 뒤에 데이터가 더 남아 있으므로 완성된 서브트리는 즉시 병합해도 루트가 아니다.
+		for total := chunkCounter; total&1 == 0; total >>= 1 {
+			depth--
+			parent := parentOutput(key, &stack[depth], &cv, flags)
+			cv = parent.chainingValue()
+		}
+		stack[depth] = cv
+		depth++
+	}
+
+	output := chunkOutput(key, data, chunkCounter, flags)
+	for depth > 0 {
+		depth--
+		cv := output.chainingValue()
+		output = parentOutput(key, &stack[depth], &cv, flags)
+	}
+	output.rootBytes(out)
+}
+
+// Sum256 returns the standard (unkeyed) 32-byte BLAKE3 hash of data.
+func Sum256(data []byte) [32]byte {
+	var out [32]byte
+	blake3Sum(out[:], &blake3IV, 0, data)
+	return out
+}
+
+// KeyedSum256 returns the 32-byte BLAKE3 keyed hash of data.
+func KeyedSum256(key [32]byte, data []byte) [32]byte {
+	var out [32]byte
+	words := loadKeyWords(&key)
+	blake3Sum(out[:], &words, flagKeyedHash, data)
+	return out
+}
+
+// DeriveKey returns the 32-byte BLAKE3 derive_key output for context and
+// key material.
+func DeriveKey(context string, material []byte) [32]byte {
+	var contextKey [32]byte
+	blake3Sum(contextKey[:], &blake3IV, flagDeriveKeyContext, []byte(context))
+	words := loadKeyWords(&contextKey)
+	var out [32]byte
+	blake3Sum(out[:], &words, flagDeriveKeyMaterial, material)
+	return out
+}
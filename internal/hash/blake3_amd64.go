@@ -0,0 +1,63 @@
+//go:build amd64
+
+package hash
+
+import "os"
+
+var (
+	hasAVX, hasAVX2 = detectAVX()
+	// JMT_DISABLE_ASM=1 forces the scalar path, e.g. to compare outputs.
+	asmDisabled = os.Getenv("JMT_DISABLE_ASM") == "1"
+)
+
+//go:noescape
+func blake3CompressX4AVX(out *[4][32]byte, blocks *[4]ParentPair, key *[8]uint32, flags uint32)
+
+//go:noescape
+func blake3CompressX8AVX2(out *[8][32]byte, blocks *[8]ParentPair, key *[8]uint32, flags uint32)
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+// detectAVX reports AVX and AVX2 support, including OS support for saving
+// the YMM state (OSXSAVE + XCR0 bits 1 and 2).
+func detectAVX() (bool, bool) {
+	maxID, _, _, _ := cpuid(0, 0)
+	if maxID < 1 {
+		return false, false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	const (
+		osxsave = 1 << 27
+		avx     = 1 << 28
+	)
+	if ecx1&osxsave == 0 || ecx1&avx == 0 {
+		return false, false
+	}
+	if xcr0, _ := xgetbv(); xcr0&0x6 != 0x6 {
+		return false, false
+	}
+	if maxID < 7 {
+		return true, false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	const avx2 = 1 << 5
+	return true, ebx7&avx2 != 0
+}
+
+func parentsX4Accelerated() bool {
+	return hasAVX && !asmDisabled
+}
+
+func parentsX8Accelerated() bool {
+	return hasAVX2 && !asmDisabled
+}
+
+func compressParentsX4Asm(out *[4][32]byte, pairs *[4]ParentPair, key *[8]uint32) {
+	blake3CompressX4AVX(out, pairs, key, flagParent|flagKeyedHash)
+}
+
+func compressParentsX8Asm(out *[8][32]byte, pairs *[8]ParentPair, key *[8]uint32) {
+	blake3CompressX8AVX2(out, pairs, key, flagParent|flagKeyedHash)
+}
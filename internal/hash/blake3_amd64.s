@@ -0,0 +1,294 @@
+//go:build amd64
+
+#include "textflag.h"
+
+// Multi-lane BLAKE3 compression for independent single-block inputs.
+// Each lane hashes one 64-byte block (left || right for a parent pair) with
+// the same key words, counter 0, block length 64 and the given flags, and
+// writes the 32-byte chaining value. The state is kept transposed (one
+// vector register per state word, one lane per input), so a G step runs on
+// every lane at once. Message words live transposed on the stack frame; one
+// c-row register is spilled around the shift-based rotations to free a temp.
+
+DATA rot16<>+0(SB)/8, $0x0504070601000302
+DATA rot16<>+8(SB)/8, $0x0D0C0F0E09080B0A
+DATA rot16<>+16(SB)/8, $0x0504070601000302
+DATA rot16<>+24(SB)/8, $0x0D0C0F0E09080B0A
+GLOBL rot16<>(SB), RODATA|NOPTR, $32
+
+DATA rot8<>+0(SB)/8, $0x0407060500030201
+DATA rot8<>+8(SB)/8, $0x0C0F0E0D080B0A09
+DATA rot8<>+16(SB)/8, $0x0407060500030201
+DATA rot8<>+24(SB)/8, $0x0C0F0E0D080B0A09
+GLOBL rot8<>(SB), RODATA|NOPTR, $32
+
+DATA iv<>+0(SB)/4, $0x6A09E667
+DATA iv<>+4(SB)/4, $0xBB67AE85
+DATA iv<>+8(SB)/4, $0x3C6EF372
+DATA iv<>+12(SB)/4, $0xA54FF53A
+DATA iv<>+16(SB)/4, $64
+GLOBL iv<>(SB), RODATA|NOPTR, $20
+
+#define ADD4(s0, s1, s2, s3, d0, d1, d2, d3) \
+	VPADDD s0, d0, d0; \
+	VPADDD s1, d1, d1; \
+	VPADDD s2, d2, d2; \
+	VPADDD s3, d3, d3
+
+#define XOR4(s0, s1, s2, s3, d0, d1, d2, d3) \
+	VPXOR s0, d0, d0; \
+	VPXOR s1, d1, d1; \
+	VPXOR s2, d2, d2; \
+	VPXOR s3, d3, d3
+
+#define SHUF4(mask, d0, d1, d2, d3) \
+	VPSHUFB mask, d0, d0; \
+	VPSHUFB mask, d1, d1; \
+	VPSHUFB mask, d2, d2; \
+	VPSHUFB mask, d3, d3
+
+#define ROTR4(n, m, t, d0, d1, d2, d3) \
+	VPSRLD $n, d0, t; \
+	VPSLLD $m, d0, d0; \
+	VPOR t, d0, d0; \
+	VPSRLD $n, d1, t; \
+	VPSLLD $m, d1, d1; \
+	VPOR t, d1, d1; \
+	VPSRLD $n, d2, t; \
+	VPSLLD $m, d2, d2; \
+	VPOR t, d2, d2; \
+	VPSRLD $n, d3, t; \
+	VPSLLD $m, d3, d3; \
+	VPOR t, d3, d3
+
+// G4 runs the BLAKE3 G function on four (a, b, c, d) columns in parallel.
+#define G4(a0, a1, a2, a3, b0, b1, b2, b3, c0, c1, c2, c3, d0, d1, d2, d3, x0, x1, x2, x3, y0, y1, y2, y3, spill) \
+	ADD4(b0, b1, b2, b3, a0, a1, a2, a3); \
+	ADD4(x0, x1, x2, x3, a0, a1, a2, a3); \
+	XOR4(a0, a1, a2, a3, d0, d1, d2, d3); \
+	SHUF4(rot16<>(SB), d0, d1, d2, d3); \
+	ADD4(d0, d1, d2, d3, c0, c1, c2, c3); \
+	XOR4(c0, c1, c2, c3, b0, b1, b2, b3); \
+	VMOVDQU c0, spill; \
+	ROTR4(12, 20, c0, b0, b1, b2, b3); \
+	VMOVDQU spill, c0; \
+	ADD4(b0, b1, b2, b3, a0, a1, a2, a3); \
+	ADD4(y0, y1, y2, y3, a0, a1, a2, a3); \
+	XOR4(a0, a1, a2, a3, d0, d1, d2, d3); \
+	SHUF4(rot8<>(SB), d0, d1, d2, d3); \
+	ADD4(d0, d1, d2, d3, c0, c1, c2, c3); \
+	XOR4(c0, c1, c2, c3, b0, b1, b2, b3); \
+	VMOVDQU c0, spill; \
+	ROTR4(7, 25, c0, b0, b1, b2, b3); \
+	VMOVDQU spill, c0
+
+// 8 lanes: message word i at MSG8(i), one YMM per state word.
+#define MSG8(i) ((i)*32)(SP)
+#define SPILL8 512(SP)
+
+#define ROUND8(m0, m1, m2, m3, m4, m5, m6, m7, m8, m9, m10, m11, m12, m13, m14, m15) \
+	G4(Y0, Y1, Y2, Y3, Y4, Y5, Y6, Y7, Y8, Y9, Y10, Y11, Y12, Y13, Y14, Y15, MSG8(m0), MSG8(m2), MSG8(m4), MSG8(m6), MSG8(m1), MSG8(m3), MSG8(m5), MSG8(m7), SPILL8); \
+	G4(Y0, Y1, Y2, Y3, Y5, Y6, Y7, Y4, Y10, Y11, Y8, Y9, Y15, Y12, Y13, Y14, MSG8(m8), MSG8(m10), MSG8(m12), MSG8(m14), MSG8(m9), MSG8(m11), MSG8(m13), MSG8(m15), SPILL8)
+
+// TRANSPOSE8 transposes the 8x8 dword matrix in Y0..Y7 into Y8..Y15.
+#define TRANSPOSE8 \
+	VPUNPCKLDQ Y1, Y0, Y8; \
+	VPUNPCKHDQ Y1, Y0, Y9; \
+	VPUNPCKLDQ Y3, Y2, Y10; \
+	VPUNPCKHDQ Y3, Y2, Y11; \
+	VPUNPCKLDQ Y5, Y4, Y12; \
+	VPUNPCKHDQ Y5, Y4, Y13; \
+	VPUNPCKLDQ Y7, Y6, Y14; \
+	VPUNPCKHDQ Y7, Y6, Y15; \
+	VPUNPCKLQDQ Y10, Y8, Y0; \
+	VPUNPCKHQDQ Y10, Y8, Y1; \
+	VPUNPCKLQDQ Y11, Y9, Y2; \
+	VPUNPCKHQDQ Y11, Y9, Y3; \
+	VPUNPCKLQDQ Y14, Y12, Y4; \
+	VPUNPCKHQDQ Y14, Y12, Y5; \
+	VPUNPCKLQDQ Y15, Y13, Y6; \
+	VPUNPCKHQDQ Y15, Y13, Y7; \
+	VPERM2I128 $0x20, Y4, Y0, Y8; \
+	VPERM2I128 $0x20, Y5, Y1, Y9; \
+	VPERM2I128 $0x20, Y6, Y2, Y10; \
+	VPERM2I128 $0x20, Y7, Y3, Y11; \
+	VPERM2I128 $0x31, Y4, Y0, Y12; \
+	VPERM2I128 $0x31, Y5, Y1, Y13; \
+	VPERM2I128 $0x31, Y6, Y2, Y14; \
+	VPERM2I128 $0x31, Y7, Y3, Y15
+
+#define LOAD_ROWS8(off) \
+	VMOVDQU (0*64+off)(SI), Y0; \
+	VMOVDQU (1*64+off)(SI), Y1; \
+	VMOVDQU (2*64+off)(SI), Y2; \
+	VMOVDQU (3*64+off)(SI), Y3; \
+	VMOVDQU (4*64+off)(SI), Y4; \
+	VMOVDQU (5*64+off)(SI), Y5; \
+	VMOVDQU (6*64+off)(SI), Y6; \
+	VMOVDQU (7*64+off)(SI), Y7
+
+#define STORE_WORDS8(base) \
+	VMOVDQU Y8, MSG8(base+0); \
+	VMOVDQU Y9, MSG8(base+1); \
+	VMOVDQU Y10, MSG8(base+2); \
+	VMOVDQU Y11, MSG8(base+3); \
+	VMOVDQU Y12, MSG8(base+4); \
+	VMOVDQU Y13, MSG8(base+5); \
+	VMOVDQU Y14, MSG8(base+6); \
+	VMOVDQU Y15, MSG8(base+7)
+
+// func blake3CompressX8AVX2(out *[8][32]byte, blocks *[8]ParentPair, key *[8]uint32, flags uint32)
+TEXT ·blake3CompressX8AVX2(SB), NOSPLIT, $544-28
+	MOVQ out+0(FP), DI
+	MOVQ blocks+8(FP), SI
+	MOVQ key+16(FP), DX
+
+	LOAD_ROWS8(0)
+	TRANSPOSE8
+	STORE_WORDS8(0)
+	LOAD_ROWS8(32)
+	TRANSPOSE8
+	STORE_WORDS8(8)
+
+	VPBROADCASTD 0(DX), Y0
+	VPBROADCASTD 4(DX), Y1
+	VPBROADCASTD 8(DX), Y2
+	VPBROADCASTD 12(DX), Y3
+	VPBROADCASTD 16(DX), Y4
+	VPBROADCASTD 20(DX), Y5
+	VPBROADCASTD 24(DX), Y6
+	VPBROADCASTD 28(DX), Y7
+	VPBROADCASTD iv<>+0(SB), Y8
+	VPBROADCASTD iv<>+4(SB), Y9
+	VPBROADCASTD iv<>+8(SB), Y10
+	VPBROADCASTD iv<>+12(SB), Y11
+	VPXOR Y12, Y12, Y12
+	VPXOR Y13, Y13, Y13
+	VPBROADCASTD iv<>+16(SB), Y14
+	MOVL flags+24(FP), AX
+	VMOVD AX, X15
+	VPBROADCASTD X15, Y15
+
+	ROUND8(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15)
+	ROUND8(2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8)
+	ROUND8(3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1)
+	ROUND8(10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6)
+	ROUND8(12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4)
+	ROUND8(9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7)
+	ROUND8(11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13)
+
+	XOR4(Y8, Y9, Y10, Y11, Y0, Y1, Y2, Y3)
+	XOR4(Y12, Y13, Y14, Y15, Y4, Y5, Y6, Y7)
+	TRANSPOSE8
+	VMOVDQU Y8, 0(DI)
+	VMOVDQU Y9, 32(DI)
+	VMOVDQU Y10, 64(DI)
+	VMOVDQU Y11, 96(DI)
+	VMOVDQU Y12, 128(DI)
+	VMOVDQU Y13, 160(DI)
+	VMOVDQU Y14, 192(DI)
+	VMOVDQU Y15, 224(DI)
+	VZEROUPPER
+	RET
+
+// 4 lanes: same schedule on XMM registers, AVX (VEX.128) only.
+#define MSG4(i) ((i)*16)(SP)
+#define SPILL4 256(SP)
+
+#define ROUND4(m0, m1, m2, m3, m4, m5, m6, m7, m8, m9, m10, m11, m12, m13, m14, m15) \
+	G4(X0, X1, X2, X3, X4, X5, X6, X7, X8, X9, X10, X11, X12, X13, X14, X15, MSG4(m0), MSG4(m2), MSG4(m4), MSG4(m6), MSG4(m1), MSG4(m3), MSG4(m5), MSG4(m7), SPILL4); \
+	G4(X0, X1, X2, X3, X5, X6, X7, X4, X10, X11, X8, X9, X15, X12, X13, X14, MSG4(m8), MSG4(m10), MSG4(m12), MSG4(m14), MSG4(m9), MSG4(m11), MSG4(m13), MSG4(m15), SPILL4)
+
+// TRANSPOSE4 transposes the 4x4 dword matrix in r0..r3 into o0..o3 using t0..t3.
+#define TRANSPOSE4(r0, r1, r2, r3, t0, t1, t2, t3, o0, o1, o2, o3) \
+	VPUNPCKLDQ r1, r0, t0; \
+	VPUNPCKHDQ r1, r0, t1; \
+	VPUNPCKLDQ r3, r2, t2; \
+	VPUNPCKHDQ r3, r2, t3; \
+	VPUNPCKLQDQ t2, t0, o0; \
+	VPUNPCKHQDQ t2, t0, o1; \
+	VPUNPCKLQDQ t3, t1, o2; \
+	VPUNPCKHQDQ t3, t1, o3
+
+#define LOAD_WORDS4(group) \
+	VMOVDQU (0*64+group*16)(SI), X0; \
+	VMOVDQU (1*64+group*16)(SI), X1; \
+	VMOVDQU (2*64+group*16)(SI), X2; \
+	VMOVDQU (3*64+group*16)(SI), X3; \
+	TRANSPOSE4(X0, X1, X2, X3, X4, X5, X6, X7, X8, X9, X10, X11); \
+	VMOVDQU X8, MSG4(group*4+0); \
+	VMOVDQU X9, MSG4(group*4+1); \
+	VMOVDQU X10, MSG4(group*4+2); \
+	VMOVDQU X11, MSG4(group*4+3)
+
+// func blake3CompressX4AVX(out *[4][32]byte, blocks *[4]ParentPair, key *[8]uint32, flags uint32)
+TEXT ·blake3CompressX4AVX(SB), NOSPLIT, $272-28
+	MOVQ out+0(FP), DI
+	MOVQ blocks+8(FP), SI
+	MOVQ key+16(FP), DX
+
+	LOAD_WORDS4(0)
+	LOAD_WORDS4(1)
+	LOAD_WORDS4(2)
+	LOAD_WORDS4(3)
+
+	VBROADCASTSS 0(DX), X0
+	VBROADCASTSS 4(DX), X1
+	VBROADCASTSS 8(DX), X2
+	VBROADCASTSS 12(DX), X3
+	VBROADCASTSS 16(DX), X4
+	VBROADCASTSS 20(DX), X5
+	VBROADCASTSS 24(DX), X6
+	VBROADCASTSS 28(DX), X7
+	VBROADCASTSS iv<>+0(SB), X8
+	VBROADCASTSS iv<>+4(SB), X9
+	VBROADCASTSS iv<>+8(SB), X10
+	VBROADCASTSS iv<>+12(SB), X11
+	VPXOR X12, X12, X12
+	VPXOR X13, X13, X13
+	VBROADCASTSS iv<>+16(SB), X14
+	MOVL flags+24(FP), AX
+	VMOVD AX, X15
+	VPSHUFD $0, X15, X15
+
+	ROUND4(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15)
+	ROUND4(2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8)
+	ROUND4(3, 4, 10, 12, 13, 2, 7, 14, 6, 5, 9, 0, 11, 15, 8, 1)
+	ROUND4(10, 7, 12, 9, 14, 3, 13, 15, 4, 0, 11, 2, 5, 8, 1, 6)
+	ROUND4(12, 13, 9, 11, 15, 10, 14, 8, 7, 2, 5, 3, 0, 1, 6, 4)
+	ROUND4(9, 14, 11, 5, 8, 12, 15, 1, 13, 3, 0, 10, 2, 6, 4, 7)
+	ROUND4(11, 15, 5, 0, 1, 9, 8, 6, 14, 10, 2, 12, 3, 4, 7, 13)
+
+	XOR4(X8, X9, X10, X11, X0, X1, X2, X3)
+	XOR4(X12, X13, X14, X15, X4, X5, X6, X7)
+	TRANSPOSE4(X0, X1, X2, X3, X8, X9, X10, X11, X12, X13, X14, X15)
+	VMOVDQU X12, 0(DI)
+	VMOVDQU X13, 32(DI)
+	VMOVDQU X14, 64(DI)
+	VMOVDQU X15, 96(DI)
+	TRANSPOSE4(X4, X5, X6, X7, X8, X9, X10, X11, X12, X13, X14, X15)
+	VMOVDQU X12, 16(DI)
+	VMOVDQU X13, 48(DI)
+	VMOVDQU X14, 80(DI)
+	VMOVDQU X15, 112(DI)
+	VZEROUPPER
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
@@ -10,7 +10,7 @@ func BenchmarkBlake3ScalarParent(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = engine.HashParent(&left, &right)
+		_ = engine.HashParent(left, right)
 	}
 }
 
@@ -32,6 +32,24 @@ func BenchmarkBlake3X4(b *testing.B) {
 	}
 }
 
+func BenchmarkBlake3X8(b *testing.B) {
+	engine := NewEngine([32]byte{1, 2, 3})
+	var pairs [8]ParentPair
+	for i := 0; i < 8; i++ {
+		pairs[i] = ParentPair{
+			Left:  seededWord(byte(i + 1)),
+			Right: seededWord(byte(i + 17)),
+		}
+	}
+
+	var out [8][32]byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.CompressParentsX8(&out, &pairs)
+	}
+}
+
 func seededWord(seed byte) [32]byte {
 	var out [32]byte
 	for i := 0; i < 32; i++ {
@@ -0,0 +1,21 @@
+//go:build !amd64
+
+package hash
+
+// 이 아키텍처에는 스펙 호환 벡터 커널이 아직 없으므로 항상 스칼라 경로를 쓴다.
+
+func parentsX4Accelerated() bool {
+	return false
+}
+
+func parentsX8Accelerated() bool {
+	return false
+}
+
+func compressParentsX4Asm(out *[4][32]byte, pairs *[4]ParentPair, key *[8]uint32) {
+	panic("hash: no x4 kernel on this architecture")
+}
+
+func compressParentsX8Asm(out *[8][32]byte, pairs *[8]ParentPair, key *[8]uint32) {
+	panic("hash: no x8 kernel on this architecture")
+}
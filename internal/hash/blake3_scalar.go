@@ -1,136 +1,129 @@
 package hash
 
-import (
-	"crypto/sha256"
-	"sync/atomic"
-)
-
 const (
 	maxTreeDepth = 256
+
+	blake3KeyPathContext = "jmt_for_mac 2026-01-01 key path"
+	blake3ValueContext   = "jmt_for_mac 2026-01-01 value"
 )
 
-type ParentPair struct {
-	Left  [32]byte
-	Right [32]byte
-}
+// Engine는 키 기반 BLAKE3로 JMT leaf/parent 해시를 계산한다.
+//
+//   - leaf   = BLAKE3 keyed_hash(key, leafKey || value), 단일 청크/단일 블록.
+//   - parent = BLAKE3 parent node chaining value (PARENT|KEYED_HASH, left || right).
+//   - zero   = BLAKE3 keyed_hash(key, "")에서 시작해 parent로 접어 올린 값.
+//   - key/value = BLAKE3 keyed_hash(derive_key(ctx, key), data), 가변 길이 입력용.
+//
+// 세 경우 모두 BLAKE3 도메인 플래그로 분리되므로 다른 BLAKE3 구현으로 검증할 수 있다.
+// x4/x8 경로는 같은 압축 함수를 독립 블록 여러 개에 적용하며, amd64에서는
+// CPUID로 고른 AVX/AVX2 커널이 레인을 병렬로 처리한다.
+type Engine struct {
+	counters
+	key      [32]byte
+	keyWords [8]uint32
+	zero     zeroTable
 
-type Stats struct {
-	LeafScalarCalls   uint64
-	ParentScalarCalls uint64
-	ParentX4Batches   uint64
-	ParentX4Pairs     uint64
-	ASMCalls          uint64
+	keyPathKey [32]byte
+	valueKey   [32]byte
 }
 
-// ParentSIMDRatio returns ParentX4Pairs / (ParentX4Pairs + ParentScalarCalls).
-// Returns 0 when the denominator is zero.
-func (s Stats) ParentSIMDRatio() float64 {
-	denom := s.ParentX4Pairs + s.ParentScalarCalls
-	if denom == 0 {
-		return 0
+// NewEngine returns a keyed BLAKE3 engine.
+func NewEngine(key [32]byte) *Engine {
+	e := &Engine{
+		key:        key,
+		keyWords:   loadKeyWords(&key),
+		keyPathKey: DeriveKey(blake3KeyPathContext, key[:]),
+		valueKey:   DeriveKey(blake3ValueContext, key[:]),
 	}
-	return float64(s.ParentX4Pairs) / float64(denom)
+	e.zero.init(KeyedSum256(key, nil), e.hashParentNoStats)
+	return e
 }
 
-// Engine는 BLAKE3 인터페이스를 흉내 낸 해시 엔진이다.
-// 실제 압축은 SHA-256 기반 도메인 분리로 구현하고, x4 라우팅 지점을 분리해 둔다.
-type Engine struct {
-	key               [32]byte
-	zero              [maxTreeDepth + 1][32]byte
-	leafScalarCalls   atomic.Uint64
-	parentScalarCalls atomic.Uint64
-	parentX4Batches   atomic.Uint64
-	parentX4Pairs     atomic.Uint64
-	asmCalls          atomic.Uint64
+func (e *Engine) Scheme() Scheme {
+	return SchemeBLAKE3
 }
 
-func NewEngine(key [32]byte) *Engine {
-	e := &Engine{key: key}
-	e.initZeroHashes()
-	return e
+func (e *Engine) ZeroHash(depth uint16) [32]byte {
+	return e.zero.at(depth)
 }
 
-func (e *Engine) initZeroHashes() {
-	var seed [33]byte
-	seed[0] = 'Z'
-	copy(seed[1:], e.key[:])
-	e.zero[maxTreeDepth] = sha256.Sum256(seed[:])
+func (e *Engine) HashLeaf(key [32]byte, value [32]byte) [32]byte {
+	e.leafScalarCalls.Add(1)
 
-	for depth := maxTreeDepth - 1; depth >= 0; depth-- {
-		parent := e.hashParentNoStats(&e.zero[depth+1], &e.zero[depth+1])
-		e.zero[depth] = parent
-	}
+	var block [16]uint32
+	loadPair(&block, &key, &value)
+	state := blake3Compress(&e.keyWords, &block, 0, blake3BlockLen, flagChunkStart|flagChunkEnd|flagRoot|flagKeyedHash)
+	cv := blake3ChainingValue(&state)
+	var out [32]byte
+	storeWords(&out, &cv)
+	return out
 }
 
-func (e *Engine) ZeroHash(depth uint16) [32]byte {
-	if depth > maxTreeDepth {
-		depth = maxTreeDepth
-	}
-	return e.zero[depth]
+func (e *Engine) HashKey(key []byte) [32]byte {
+	return KeyedSum256(e.keyPathKey, key)
 }
 
-func (e *Engine) HashLeaf(key *[32]byte, value *[32]byte) [32]byte {
-	var payload [97]byte
-	payload[0] = 'L'
-	copy(payload[1:33], e.key[:])
-	copy(payload[33:65], key[:])
-	copy(payload[65:97], value[:])
-
-	e.leafScalarCalls.Add(1)
-	return sha256.Sum256(payload[:])
+func (e *Engine) HashValue(value []byte) [32]byte {
+	return KeyedSum256(e.valueKey, value)
 }
 
-func (e *Engine) HashParent(left *[32]byte, right *[32]byte) [32]byte {
+func (e *Engine) HashParent(left [32]byte, right [32]byte) [32]byte {
 	e.parentScalarCalls.Add(1)
 	return e.hashParentNoStats(left, right)
 }
 
-func (e *Engine) hashParentNoStats(left *[32]byte, right *[32]byte) [32]byte {
-	var payload [97]byte
-	payload[0] = 'P'
-	copy(payload[1:33], e.key[:])
-	copy(payload[33:65], left[:])
-	copy(payload[65:97], right[:])
-	return sha256.Sum256(payload[:])
+func (e *Engine) hashParentNoStats(left [32]byte, right [32]byte) [32]byte {
+	var block [16]uint32
+	loadPair(&block, &left, &right)
+	state := blake3Compress(&e.keyWords, &block, 0, blake3BlockLen, flagParent|flagKeyedHash)
+	cv := blake3ChainingValue(&state)
+	var out [32]byte
+	storeWords(&out, &cv)
+	return out
 }
 
+// CompressParentsX4 hashes four parent pairs. On amd64 with AVX the lanes
+// run through the vector kernel; otherwise each pair is compressed in turn.
 func (e *Engine) CompressParentsX4(out *[4][32]byte, pairs *[4]ParentPair) {
-	e.parentX4Batches.Add(1)
-	e.parentX4Pairs.Add(4)
-
-	// asm 경로는 환경 변수로 명시적으로 활성화할 때만 호출한다.
-	// 정확성은 스칼라 해시로 보장한다.
-	if neonAvailable() {
-		var packed [256]byte
-		for i := 0; i < 4; i++ {
-			base := i * 64
-			copy(packed[base:base+32], pairs[i].Left[:])
-			copy(packed[base+32:base+64], pairs[i].Right[:])
-		}
-		var scratch [128]byte
-		neonCompress(&scratch, &packed, &e.key)
+	e.countBatch(4)
+	if parentsX4Accelerated() {
+		compressParentsX4Asm(out, pairs, &e.keyWords)
 		e.asmCalls.Add(1)
+		return
 	}
+	e.compressLanes(out[:], pairs[:])
+}
 
-	for i := 0; i < 4; i++ {
-		out[i] = e.hashParentNoStats(&pairs[i].Left, &pairs[i].Right)
-	}
+// CompressParentsX8 hashes eight parent pairs with the AVX2 kernel when
+// available.
+func (e *Engine) CompressParentsX8(out *[8][32]byte, pairs *[8]ParentPair) {
+	e.countBatch(8)
+	e.compressX8(out, pairs)
+}
+
+// CompressParentsX16 hashes sixteen parent pairs as two x8 kernel calls.
+func (e *Engine) CompressParentsX16(out *[16][32]byte, pairs *[16]ParentPair) {
+	e.countBatch(16)
+	e.compressX8((*[8][32]byte)(out[:8]), (*[8]ParentPair)(pairs[:8]))
+	e.compressX8((*[8][32]byte)(out[8:]), (*[8]ParentPair)(pairs[8:]))
 }
 
-func (e *Engine) Stats() Stats {
-	return Stats{
-		LeafScalarCalls:   e.leafScalarCalls.Load(),
-		ParentScalarCalls: e.parentScalarCalls.Load(),
-		ParentX4Batches:   e.parentX4Batches.Load(),
-		ParentX4Pairs:     e.parentX4Pairs.Load(),
-		ASMCalls:          e.asmCalls.Load(),
+func (e *Engine) compressX8(out *[8][32]byte, pairs *[8]ParentPair) {
+	switch {
+	case parentsX8Accelerated():
+		compressParentsX8Asm(out, pairs, &e.keyWords)
+		e.asmCalls.Add(1)
+	case parentsX4Accelerated():
+		compressParentsX4Asm((*[4][32]byte)(out[:4]), (*[4]ParentPair)(pairs[:4]), &e.keyWords)
+		compressParentsX4Asm((*[4][32]byte)(out[4:]), (*[4]ParentPair)(pairs[4:]), &e.keyWords)
+		e.asmCalls.Add(2)
+	default:
+		e.compressLanes(out[:], pairs[:])
 	}
 }
 
-func (e *Engine) ResetStats() {
-	e.leafScalarCalls.Store(0)
-	e.parentScalarCalls.Store(0)
-	e.parentX4Batches.Store(0)
-	e.parentX4Pairs.Store(0)
-	e.asmCalls.Store(0)
+func (e *Engine) compressLanes(out [][32]byte, pairs []ParentPair) {
+	for i := range pairs {
+		out[i] = e.hashParentNoStats(pairs[i].Left, pairs[i].Right)
+	}
 }
@@ -0,0 +1,253 @@
+package hash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"os"
+	"testing"
+)
+
+type blake3Vectors struct {
+	Key   string `json:"key"`
+	Cases []struct {
+		InputLen  int    `json:"input_len"`
+		Hash      string `json:"hash"`
+		KeyedHash string `json:"keyed_hash"`
+		DeriveKey string `json:"derive_key"`
+	} `json:"cases"`
+}
+
+// blake3VectorContext is the derive_key context of the official vectors.
+const blake3VectorContext = "BLAKE3 2019-12-27 16:29:52 test vectors context"
+
+func loadBlake3Vectors(t *testing.T) ([32]byte, blake3Vectors) {
+	t.Helper()
+	raw, err := os.ReadFile("testdata/blake3_vectors.json")
+	if err != nil {
+		t.Fatalf("read vectors: %v", err)
+	}
+	var vectors blake3Vectors
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatalf("decode vectors: %v", err)
+	}
+	var key [32]byte
+	if copy(key[:], vectors.Key) != len(key) {
+		t.Fatalf("unexpected vector key length: %d", len(vectors.Key))
+	}
+	return key, vectors
+}
+
+func vectorInput(n int) []byte {
+	input := make([]byte, n)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	return input
+}
+
+func TestBlake3OfficialVectors(t *testing.T) {
+	key, vectors := loadBlake3Vectors(t)
+	keyWords := loadKeyWords(&key)
+
+	for _, tc := range vectors.Cases {
+		input := vectorInput(tc.InputLen)
+
+		want, _ := hex.DecodeString(tc.Hash)
+		got := make([]byte, len(want))
+		blake3Sum(got, &blake3IV, 0, input)
+		if !bytes.Equal(got, want) {
+			t.Errorf("hash len=%d mismatch", tc.InputLen)
+		}
+		if sum := Sum256(input); !bytes.Equal(sum[:], want[:32]) {
+			t.Errorf("Sum256 len=%d mismatch", tc.InputLen)
+		}
+
+		want, _ = hex.DecodeString(tc.KeyedHash)
+		got = make([]byte, len(want))
+		blake3Sum(got, &keyWords, flagKeyedHash, input)
+		if !bytes.Equal(got, want) {
+			t.Errorf("keyed_hash len=%d mismatch", tc.InputLen)
+		}
+		if sum := KeyedSum256(key, input); !bytes.Equal(sum[:], want[:32]) {
+			t.Errorf("KeyedSum256 len=%d mismatch", tc.InputLen)
+		}
+
+		want, _ = hex.DecodeString(tc.DeriveKey)
+		if sum := DeriveKey(blake3VectorContext, input); !bytes.Equal(sum[:], want[:32]) {
+			t.Errorf("DeriveKey len=%d mismatch", tc.InputLen)
+		}
+	}
+}
+
+func TestEngineMatchesBlake3TreeMode(t *testing.T) {
+	key, vectors := loadBlake3Vectors(t)
+	engine := NewEngine(key)
+
+	leafKey := seededWord(0x10)
+	value := seededWord(0x90)
+	var payload [64]byte
+	copy(payload[:32], leafKey[:])
+	copy(payload[32:], value[:])
+	if got, want := engine.HashLeaf(leafKey, value), KeyedSum256(key, payload[:]); got != want {
+		t.Fatalf("leaf hash is not keyed BLAKE3 of key||value")
+	}
+	if got, want := engine.ZeroHash(maxTreeDepth), KeyedSum256(key, nil); got != want {
+		t.Fatalf("zero leaf is not keyed BLAKE3 of empty input")
+	}
+
+	// 4청크 입력의 keyed 루트 = root(parent(c0,c1), parent(c2,c3)).
+	// 내부 parent chaining value는 Engine.HashParent와 같아야 한다.
+	input := vectorInput(4 * blake3ChunkLen)
+	var chunkCVs [4][32]byte
+	for i := range chunkCVs {
+		chunk := chunkOutput(&engine.keyWords, input[i*blake3ChunkLen:(i+1)*blake3ChunkLen], uint64(i), flagKeyedHash)
+		cv := chunk.chainingValue()
+		storeWords(&chunkCVs[i], &cv)
+	}
+	left := engine.HashParent(chunkCVs[0], chunkCVs[1])
+	right := engine.HashParent(chunkCVs[2], chunkCVs[3])
+	leftWords := loadKeyWords(&left)
+	rightWords := loadKeyWords(&right)
+	root := parentOutput(&engine.keyWords, &leftWords, &rightWords, flagKeyedHash)
+	var got [32]byte
+	root.rootBytes(got[:])
+
+	for _, tc := range vectors.Cases {
+		if tc.InputLen != len(input) {
+			continue
+		}
+		want, _ := hex.DecodeString(tc.KeyedHash)
+		if !bytes.Equal(got[:], want[:32]) {
+			t.Fatalf("parent chaining values do not reproduce official keyed root")
+		}
+		return
+	}
+	t.Fatalf("vector for input_len=%d not found", len(input))
+}
+
+func TestCompressParentsBatchesMatchScalar(t *testing.T) {
+	for _, scheme := range []Scheme{SchemeBLAKE3, SchemeSHA256, SchemeSHA3} {
+		engine, err := New(scheme, [32]byte{7})
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		var pairs [16]ParentPair
+		for i := range pairs {
+			pairs[i] = ParentPair{Left: seededWord(byte(i)), Right: seededWord(byte(i + 40))}
+		}
+		var out4 [4][32]byte
+		var out8 [8][32]byte
+		var out16 [16][32]byte
+		engine.CompressParentsX4(&out4, (*[4]ParentPair)(pairs[:4]))
+		engine.CompressParentsX8(&out8, (*[8]ParentPair)(pairs[:8]))
+		engine.CompressParentsX16(&out16, &pairs)
+
+		stats := engine.Stats()
+		if stats.ParentX4Pairs != 4 || stats.ParentX8Pairs != 8 || stats.ParentX16Pairs != 16 {
+			t.Fatalf("%s: unexpected per-width stats: %+v", scheme, stats)
+		}
+		for i := range pairs {
+			want := engine.HashParent(pairs[i].Left, pairs[i].Right)
+			if out16[i] != want || (i < 8 && out8[i] != want) || (i < 4 && out4[i] != want) {
+				t.Fatalf("%s: lane %d mismatch", scheme, i)
+			}
+		}
+	}
+}
+
+func TestBackendsAreDomainSeparated(t *testing.T) {
+	key := [32]byte{9}
+	leafKey := seededWord(0x21)
+	value := seededWord(0x42)
+
+	seen := make(map[[32]byte]string)
+	for _, scheme := range []Scheme{SchemeBLAKE3, SchemeSHA256, SchemeSHA3} {
+		engine, err := New(scheme, key)
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if engine.Scheme() != scheme {
+			t.Fatalf("%s: scheme mismatch", scheme)
+		}
+		zero := engine.ZeroHash(maxTreeDepth)
+		if engine.ZeroHash(maxTreeDepth-1) != engine.HashParent(zero, zero) {
+			t.Fatalf("%s: zero table is not folded with parent hash", scheme)
+		}
+		leaf := engine.HashLeaf(leafKey, value)
+		parent := engine.HashParent(leafKey, value)
+		if leaf == parent {
+			t.Fatalf("%s: leaf and parent domains collide", scheme)
+		}
+		raw := append(leafKey[:], value[:]...)
+		keyHash := engine.HashKey(raw)
+		valueHash := engine.HashValue(raw)
+		if keyHash == valueHash {
+			t.Fatalf("%s: key and value domains collide", scheme)
+		}
+		for _, h := range [][32]byte{leaf, parent, zero, keyHash, valueHash} {
+			if prev, ok := seen[h]; ok {
+				t.Fatalf("%s output collides with %s", scheme, prev)
+			}
+			seen[h] = scheme.String()
+		}
+	}
+
+	if _, err := New(Scheme(255), key); err != ErrUnknownScheme {
+		t.Fatalf("unexpected error for unknown scheme: %v", err)
+	}
+}
+
+func TestVectorKernelsMatchScalar(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	fill := func(w *[32]byte) {
+		for i := range w {
+			w[i] = byte(rng.Uint32())
+		}
+	}
+
+	var key [32]byte
+	fill(&key)
+	engine := NewEngine(key)
+
+	wantASM := uint64(0)
+	switch {
+	case parentsX8Accelerated():
+		wantASM = 1 + 1 + 2
+	case parentsX4Accelerated():
+		wantASM = 1 + 2 + 4
+	}
+
+	for iter := 0; iter < 64; iter++ {
+		var pairs [16]ParentPair
+		for i := range pairs {
+			fill(&pairs[i].Left)
+			fill(&pairs[i].Right)
+		}
+
+		engine.ResetStats()
+		var out4 [4][32]byte
+		var out8 [8][32]byte
+		var out16 [16][32]byte
+		engine.CompressParentsX4(&out4, (*[4]ParentPair)(pairs[:4]))
+		engine.CompressParentsX8(&out8, (*[8]ParentPair)(pairs[:8]))
+		engine.CompressParentsX16(&out16, &pairs)
+
+		for i := range pairs {
+			want := engine.hashParentNoStats(pairs[i].Left, pairs[i].Right)
+			if out16[i] != want {
+				t.Fatalf("x16 lane %d mismatch", i)
+			}
+			if i < 8 && out8[i] != want {
+				t.Fatalf("x8 lane %d mismatch", i)
+			}
+			if i < 4 && out4[i] != want {
+				t.Fatalf("x4 lane %d mismatch", i)
+			}
+		}
+		if got := engine.Stats().ASMCalls; got != wantASM {
+			t.Fatalf("asm calls = %d, want %d", got, wantASM)
+		}
+	}
+}
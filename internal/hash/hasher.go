@@ -0,0 +1,187 @@
+package hash
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrUnknownScheme = errors.New("unknown hash scheme")
+
+// Scheme identifies a hash backend.
+type Scheme uint8
+
+const (
+	// SchemeBLAKE3 uses keyed BLAKE3 compression (default).
+	SchemeBLAKE3 Scheme = iota
+	// SchemeSHA256 keeps the original 'L'/'P'/'Z' prefixed SHA-256
+	// construction so roots committed before BLAKE3 can still be reproduced.
+	SchemeSHA256
+	// SchemeSHA3 uses SHA3-256 with keyed 32-byte domain salts.
+	SchemeSHA3
+	// SchemeAptos hashes leaves, internal nodes and empty subtrees like the
+	// Aptos sparse Merkle tree so its verifiers accept the proofs. It is
+	// unkeyed.
+	SchemeAptos
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case SchemeBLAKE3:
+		return "blake3"
+	case SchemeSHA256:
+		return "sha256"
+	case SchemeSHA3:
+		return "sha3-256"
+	case SchemeAptos:
+		return "aptos"
+	default:
+		return "unknown"
+	}
+}
+
+// Hasher is the hash backend shared by the tree, the SIMD router and proof
+// verification. Leaf and parent hashing take values so callers never leak
+// stack words through the interface; the batch entry points take pointers
+// because callers keep the lanes in long-lived buffers. There is one batch
+// entry point per supported lane width.
+type Hasher interface {
+	Scheme() Scheme
+	HashLeaf(key [32]byte, value [32]byte) [32]byte
+	HashParent(left [32]byte, right [32]byte) [32]byte
+	CompressParentsX4(out *[4][32]byte, pairs *[4]ParentPair)
+	CompressParentsX8(out *[8][32]byte, pairs *[8]ParentPair)
+	CompressParentsX16(out *[16][32]byte, pairs *[16]ParentPair)
+	// HashKey maps a variable-length key to its 256-bit tree path.
+	HashKey(key []byte) [32]byte
+	// HashValue commits to a variable-length value; the leaf hashes the
+	// result in place of the value.
+	HashValue(value []byte) [32]byte
+	// ZeroHash returns the hash of an empty subtree rooted at depth.
+	ZeroHash(depth uint16) [32]byte
+	Stats() Stats
+	ResetStats()
+}
+
+// New returns the backend for scheme, keyed with key. SchemeAptos ignores
+// key.
+func New(scheme Scheme, key [32]byte) (Hasher, error) {
+	switch scheme {
+	case SchemeBLAKE3:
+		return NewEngine(key), nil
+	case SchemeSHA256:
+		return NewSHA256Engine(key), nil
+	case SchemeSHA3:
+		return NewSHA3Engine(key), nil
+	case SchemeAptos:
+		return NewAptosEngine(), nil
+	default:
+		return nil, ErrUnknownScheme
+	}
+}
+
+type ParentPair struct {
+	Left  [32]byte
+	Right [32]byte
+}
+
+type Stats struct {
+	LeafScalarCalls   uint64
+	ParentScalarCalls uint64
+	ParentX4Batches   uint64
+	ParentX4Pairs     uint64
+	ParentX8Batches   uint64
+	ParentX8Pairs     uint64
+	ParentX16Batches  uint64
+	ParentX16Pairs    uint64
+	ASMCalls          uint64
+}
+
+// ParentSIMDPairs returns the parent pairs hashed through any batch width.
+func (s Stats) ParentSIMDPairs() uint64 {
+	return s.ParentX4Pairs + s.ParentX8Pairs + s.ParentX16Pairs
+}
+
+// ParentSIMDRatio returns ParentSIMDPairs / (ParentSIMDPairs + ParentScalarCalls).
+// Returns 0 when the denominator is zero. It counts pairs routed through the
+// batched path, not vector execution; ASMCalls tells whether a kernel ran.
+func (s Stats) ParentSIMDRatio() float64 {
+	simd := s.ParentSIMDPairs()
+	denom := simd + s.ParentScalarCalls
+	if denom == 0 {
+		return 0
+	}
+	return float64(simd) / float64(denom)
+}
+
+// counters는 백엔드 공통 통계 카운터다.
+type counters struct {
+	leafScalarCalls   atomic.Uint64
+	parentScalarCalls atomic.Uint64
+	parentX4Batches   atomic.Uint64
+	parentX4Pairs     atomic.Uint64
+	parentX8Batches   atomic.Uint64
+	parentX8Pairs     atomic.Uint64
+	parentX16Batches  atomic.Uint64
+	parentX16Pairs    atomic.Uint64
+	asmCalls          atomic.Uint64
+}
+
+// countBatch records one batch of n lanes under its width counters.
+func (c *counters) countBatch(lanes int) {
+	switch lanes {
+	case 4:
+		c.parentX4Batches.Add(1)
+		c.parentX4Pairs.Add(4)
+	case 8:
+		c.parentX8Batches.Add(1)
+		c.parentX8Pairs.Add(8)
+	case 16:
+		c.parentX16Batches.Add(1)
+		c.parentX16Pairs.Add(16)
+	}
+}
+
+func (c *counters) Stats() Stats {
+	return Stats{
+		LeafScalarCalls:   c.leafScalarCalls.Load(),
+		ParentScalarCalls: c.parentScalarCalls.Load(),
+		ParentX4Batches:   c.parentX4Batches.Load(),
+		ParentX4Pairs:     c.parentX4Pairs.Load(),
+		ParentX8Batches:   c.parentX8Batches.Load(),
+		ParentX8Pairs:     c.parentX8Pairs.Load(),
+		ParentX16Batches:  c.parentX16Batches.Load(),
+		ParentX16Pairs:    c.parentX16Pairs.Load(),
+		ASMCalls:          c.asmCalls.Load(),
+	}
+}
+
+func (c *counters) ResetStats() {
+	c.leafScalarCalls.Store(0)
+	c.parentScalarCalls.Store(0)
+	c.parentX4Batches.Store(0)
+	c.parentX4Pairs.Store(0)
+	c.parentX8Batches.Store(0)
+	c.parentX8Pairs.Store(0)
+	c.parentX16Batches.Store(0)
+	c.parentX16Pairs.Store(0)
+	c.asmCalls.Store(0)
+}
+
+// zeroTable holds empty-subtree hashes for every depth. zero[maxTreeDepth] is
+// the backend's empty leaf, and each shallower entry is the parent of two
+// copies of the entry below it.
+type zeroTable [maxTreeDepth + 1][32]byte
+
+func (z *zeroTable) init(emptyLeaf [32]byte, parent func(left, right [32]byte) [32]byte) {
+	z[maxTreeDepth] = emptyLeaf
+	for depth := maxTreeDepth - 1; depth >= 0; depth-- {
+		z[depth] = parent(z[depth+1], z[depth+1])
+	}
+}
+
+func (z *zeroTable) at(depth uint16) [32]byte {
+	if depth > maxTreeDepth {
+		depth = maxTreeDepth
+	}
+	return z[depth]
+}
@@ -0,0 +1,95 @@
+package hash
+
+import "crypto/sha256"
+
+// SHA256Engine는 BLAKE3 이전의 SHA-256 구성을 그대로 유지한다.
+//
+//   - leaf   = SHA-256('L' || key || leafKey || value)
+//   - parent = SHA-256('P' || key || left || right)
+//   - zero   = SHA-256('Z' || key)에서 시작해 parent로 접어 올린 값.
+//   - key    = SHA-256('K' || key || data), value = SHA-256('V' || key || data).
+type SHA256Engine struct {
+	counters
+	key  [32]byte
+	zero zeroTable
+}
+
+func NewSHA256Engine(key [32]byte) *SHA256Engine {
+	e := &SHA256Engine{key: key}
+	var seed [33]byte
+	seed[0] = 'Z'
+	copy(seed[1:], key[:])
+	e.zero.init(sha256.Sum256(seed[:]), e.hashParentNoStats)
+	return e
+}
+
+func (e *SHA256Engine) Scheme() Scheme {
+	return SchemeSHA256
+}
+
+func (e *SHA256Engine) ZeroHash(depth uint16) [32]byte {
+	return e.zero.at(depth)
+}
+
+func (e *SHA256Engine) HashLeaf(key [32]byte, value [32]byte) [32]byte {
+	e.leafScalarCalls.Add(1)
+	var payload [97]byte
+	payload[0] = 'L'
+	copy(payload[1:33], e.key[:])
+	copy(payload[33:65], key[:])
+	copy(payload[65:97], value[:])
+	return sha256.Sum256(payload[:])
+}
+
+func (e *SHA256Engine) HashKey(key []byte) [32]byte {
+	return e.sumTagged('K', key)
+}
+
+func (e *SHA256Engine) HashValue(value []byte) [32]byte {
+	return e.sumTagged('V', value)
+}
+
+func (e *SHA256Engine) sumTagged(tag byte, data []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{tag})
+	h.Write(e.key[:])
+	h.Write(data)
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+func (e *SHA256Engine) HashParent(left [32]byte, right [32]byte) [32]byte {
+	e.parentScalarCalls.Add(1)
+	return e.hashParentNoStats(left, right)
+}
+
+func (e *SHA256Engine) hashParentNoStats(left [32]byte, right [32]byte) [32]byte {
+	var payload [97]byte
+	payload[0] = 'P'
+	copy(payload[1:33], e.key[:])
+	copy(payload[33:65], left[:])
+	copy(payload[65:97], right[:])
+	return sha256.Sum256(payload[:])
+}
+
+func (e *SHA256Engine) CompressParentsX4(out *[4][32]byte, pairs *[4]ParentPair) {
+	e.countBatch(4)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA256Engine) CompressParentsX8(out *[8][32]byte, pairs *[8]ParentPair) {
+	e.countBatch(8)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA256Engine) CompressParentsX16(out *[16][32]byte, pairs *[16]ParentPair) {
+	e.countBatch(16)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA256Engine) compressLanes(out [][32]byte, pairs []ParentPair) {
+	for i := range pairs {
+		out[i] = e.hashParentNoStats(pairs[i].Left, pairs[i].Right)
+	}
+}
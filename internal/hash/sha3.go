@@ -0,0 +1,107 @@
+package hash
+
+import "crypto/sha3"
+
+// SHA3Engine는 SHA3-256 백엔드다. 도메인마다 키에서 유도한 32바이트 salt를
+// 앞에 붙여 leaf/parent/empty를 분리한다.
+//
+//   - salt_d = SHA3-256("JMT::" || d || key), d ∈ {Leaf, Internal, Empty, Key, Value}
+//   - leaf   = SHA3-256(salt_Leaf || leafKey || value)
+//   - parent = SHA3-256(salt_Internal || left || right)
+//   - zero   = salt_Empty에서 시작해 parent로 접어 올린 값.
+//   - key    = SHA3-256(salt_Key || data), value = SHA3-256(salt_Value || data)
+type SHA3Engine struct {
+	counters
+	leafSalt   [32]byte
+	parentSalt [32]byte
+	keySalt    [32]byte
+	valueSalt  [32]byte
+	zero       zeroTable
+}
+
+func NewSHA3Engine(key [32]byte) *SHA3Engine {
+	e := &SHA3Engine{
+		leafSalt:   sha3Salt("Leaf", key),
+		parentSalt: sha3Salt("Internal", key),
+		keySalt:    sha3Salt("Key", key),
+		valueSalt:  sha3Salt("Value", key),
+	}
+	e.zero.init(sha3Salt("Empty", key), e.hashParentNoStats)
+	return e
+}
+
+func sha3Salt(domain string, key [32]byte) [32]byte {
+	buf := make([]byte, 0, 5+len(domain)+len(key))
+	buf = append(buf, "JMT::"...)
+	buf = append(buf, domain...)
+	buf = append(buf, key[:]...)
+	return sha3.Sum256(buf)
+}
+
+func (e *SHA3Engine) Scheme() Scheme {
+	return SchemeSHA3
+}
+
+func (e *SHA3Engine) ZeroHash(depth uint16) [32]byte {
+	return e.zero.at(depth)
+}
+
+func (e *SHA3Engine) HashLeaf(key [32]byte, value [32]byte) [32]byte {
+	e.leafScalarCalls.Add(1)
+	var payload [96]byte
+	copy(payload[:32], e.leafSalt[:])
+	copy(payload[32:64], key[:])
+	copy(payload[64:], value[:])
+	return sha3.Sum256(payload[:])
+}
+
+func (e *SHA3Engine) HashKey(key []byte) [32]byte {
+	return sumSalted(&e.keySalt, key)
+}
+
+func (e *SHA3Engine) HashValue(value []byte) [32]byte {
+	return sumSalted(&e.valueSalt, value)
+}
+
+func sumSalted(salt *[32]byte, data []byte) [32]byte {
+	h := sha3.New256()
+	h.Write(salt[:])
+	h.Write(data)
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+func (e *SHA3Engine) HashParent(left [32]byte, right [32]byte) [32]byte {
+	e.parentScalarCalls.Add(1)
+	return e.hashParentNoStats(left, right)
+}
+
+func (e *SHA3Engine) hashParentNoStats(left [32]byte, right [32]byte) [32]byte {
+	var payload [96]byte
+	copy(payload[:32], e.parentSalt[:])
+	copy(payload[32:64], left[:])
+	copy(payload[64:], right[:])
+	return sha3.Sum256(payload[:])
+}
+
+func (e *SHA3Engine) CompressParentsX4(out *[4][32]byte, pairs *[4]ParentPair) {
+	e.countBatch(4)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA3Engine) CompressParentsX8(out *[8][32]byte, pairs *[8]ParentPair) {
+	e.countBatch(8)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA3Engine) CompressParentsX16(out *[16][32]byte, pairs *[16]ParentPair) {
+	e.countBatch(16)
+	e.compressLanes(out[:], pairs[:])
+}
+
+func (e *SHA3Engine) compressLanes(out [][32]byte, pairs []ParentPair) {
+	for i := range pairs {
+		out[i] = e.hashParentNoStats(pairs[i].Left, pairs[i].Right)
+	}
+}
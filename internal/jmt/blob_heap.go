@@ -0,0 +1,104 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"arena"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+var ErrBlobTooLarge = errors.New("key or value exceeds blob size limit")
+
+// BlobRef는 epoch 저장소 안의 blob 레코드 위치다. Chunk는 1부터 세며 0은 blob
+// 없음이다. 그 밖의 뜻은 EpochStore 구현이 정한다.
+type BlobRef struct {
+	Chunk  uint32
+	Offset uint32
+}
+
+//go:inline
+func (r BlobRef) valid() bool {
+	return r.Chunk != 0
+}
+
+// blobMark is a writer cursor saved before a batch so a failed commit can
+// drop the records it appended.
+type blobMark struct {
+	chunk  int
+	offset int
+}
+
+// blobHeap은 가변 길이 key/value 레코드를 epoch arena 안의 청크에 이어 붙인다.
+// 레코드 = keyLen(u32 LE) || valueLen(u32 LE) || key || value.
+// 청크 디렉터리는 청크를 추가할 때만 새로 만들어 atomic으로 게시하므로 reader는 잠금 없이 읽는다.
+type blobHeap struct {
+	dir    atomic.Pointer[[][]byte]
+	chunks [][]byte // writer's view of dir
+	cursor blobMark
+}
+
+func (h *blobHeap) append(mem *arena.Arena, key []byte, value []byte) (BlobRef, error) {
+	need := blobHeaderSize + len(key) + len(value)
+	if uint64(need) > math.MaxUint32 {
+		return BlobRef{}, ErrBlobTooLarge
+	}
+
+	c := &h.cursor
+	for c.chunk < len(h.chunks) && c.offset+need > len(h.chunks[c.chunk]) {
+		c.chunk++
+		c.offset = 0
+	}
+	if c.chunk == len(h.chunks) {
+		size := max(need, blobChunkSize)
+		chunks := append(h.chunks[:len(h.chunks):len(h.chunks)], arena.MakeSlice[byte](mem, size, size))
+		h.chunks = chunks
+		h.dir.Store(&chunks)
+	}
+
+	buf := h.chunks[c.chunk][c.offset:]
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(value)))
+	copy(buf[blobHeaderSize:], key)
+	copy(buf[blobHeaderSize+len(key):], value)
+
+	ref := BlobRef{Chunk: uint32(c.chunk) + 1, Offset: uint32(c.offset)}
+	c.offset += need
+	return ref, nil
+}
+
+// record returns the key and value stored at ref. The slices alias arena
+// memory and are only valid while the epoch is retained.
+func (h *blobHeap) record(ref BlobRef) ([]byte, []byte, bool) {
+	dir := h.dir.Load()
+	if !ref.valid() || dir == nil || int(ref.Chunk) > len(*dir) {
+		return nil, nil, false
+	}
+	chunk := (*dir)[ref.Chunk-1]
+	if int(ref.Offset)+blobHeaderSize > len(chunk) {
+		return nil, nil, false
+	}
+	buf := chunk[ref.Offset:]
+	keyLen := int(binary.LittleEndian.Uint32(buf[0:]))
+	valueLen := int(binary.LittleEndian.Uint32(buf[4:]))
+	if blobHeaderSize+keyLen+valueLen > len(buf) {
+		return nil, nil, false
+	}
+	key := buf[blobHeaderSize : blobHeaderSize+keyLen]
+	value := buf[blobHeaderSize+keyLen : blobHeaderSize+keyLen+valueLen]
+	return key, value, true
+}
+
+// reset rewinds the cursor but keeps the chunks so a reused epoch refills
+// them instead of growing its arena.
+func (h *blobHeap) reset() {
+	h.cursor = blobMark{}
+}
+
+func (h *blobHeap) release() {
+	h.dir.Store(nil)
+	h.chunks = nil
+	h.cursor = blobMark{}
+}
@@ -0,0 +1,181 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+// branch는 retained version 위에 쌓는 이름 있는 head다. base 이하의 노드는 main과
+// locator로 공유하고, branch가 쓴 노드는 자기 epoch에만 들어가므로 Abandon 시 통째로 반납된다.
+type branch struct {
+	base     uint64
+	head     *Snapshot
+	versions []rootRef // base+1, base+2, ...
+	epoch    EpochStore
+	// log holds the write-ahead log payload of each version, written as one
+	// record on Promote.
+	log [][]byte
+}
+
+// Fork creates a branch named name whose head is the retained version. The
+// version stays retained until the branch is promoted or abandoned.
+func (t *StateTree) Fork(name string, version uint64) (Snapshot, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if _, ok := t.versions.branches[name]; ok {
+		return Snapshot{}, ErrBranchExists
+	}
+	ref, ok := t.versions.versionRoots[version]
+	if !ok {
+		return Snapshot{}, ErrUnknownVersion
+	}
+	if _, ok := t.memory.epochByID[ref.epochID]; !ok {
+		return Snapshot{}, ErrUnknownVersion
+	}
+	head := ref.snapshot(version)
+	t.versions.branches[name] = &branch{base: version, head: &head}
+	t.versions.pinned[version]++
+	return head, nil
+}
+
+// ApplyBatchOn commits mutations on top of the branch's head. It does not
+// touch the main head.
+func (t *StateTree) ApplyBatchOn(name string, mutations []Mutation) (Snapshot, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if t.updater.staged != nil {
+		return Snapshot{}, ErrStagePending
+	}
+	b, ok := t.versions.branches[name]
+	if !ok {
+		return Snapshot{}, ErrUnknownBranch
+	}
+	if err := t.checkPreconditions(b.head.RootIndex, mutations); err != nil {
+		return Snapshot{}, err
+	}
+	normalized := t.updater.dirtyQueue.normalize(mutations)
+	if len(normalized) == 0 {
+		return *b.head, nil
+	}
+
+	nextVersion := b.head.Version + 1
+	ref, _, err := t.commitLocked(b.head.RootIndex, normalized, nextVersion, &b.epoch)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	b.versions = append(b.versions, ref)
+	if t.wal != nil {
+		b.log = append(b.log, appendWALBatch(nil, nextVersion, ref.rootHash, normalized))
+	}
+	t.countVersionLocked(ref.epochID, nextVersion)
+	// reader가 이전 head를 들고 있을 수 있으므로 head는 매번 새로 만든다.
+	head := ref.snapshot(nextVersion)
+	b.head = &head
+	return head, nil
+}
+
+// AcquireBranch opens a read transaction at the branch's head.
+func (t *StateTree) AcquireBranch(name string) (ReadTxn, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	b, ok := t.versions.branches[name]
+	if !ok {
+		return ReadTxn{}, ErrUnknownBranch
+	}
+	slot := t.enterReader()
+	slot.observe(b.head.Version)
+	return ReadTxn{tree: t, snapshot: b.head, slot: slot}, nil
+}
+
+// Promote makes the branch the main head. Main versions newer than the
+// branch's base are discarded as by Rollback and the branch's versions take
+// their numbers.
+func (t *StateTree) Promote(name string) (Snapshot, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if t.updater.staged != nil {
+		return Snapshot{}, ErrStagePending
+	}
+	b, ok := t.versions.branches[name]
+	if !ok {
+		return Snapshot{}, ErrUnknownBranch
+	}
+	baseRef, ok := t.versions.versionRoots[b.base]
+	if !ok {
+		return Snapshot{}, ErrUnknownVersion
+	}
+	baseEpoch, ok := t.memory.epochByID[baseRef.epochID]
+	if !ok {
+		return Snapshot{}, ErrUnknownVersion
+	}
+	if t.pinnedAfterLocked(b.base) {
+		return Snapshot{}, ErrVersionPinned
+	}
+	if t.wal != nil && b.base < t.wal.base {
+		return Snapshot{}, ErrWALBase
+	}
+	if err := t.logPromoteLocked(b, baseRef.rootHash); err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := t.writableSnapshotSlot(b.head.Version)
+	*snapshot = *b.head
+	t.storeLatestLocked(snapshot)
+	// branch가 아직 등록된 상태에서 잘라야 branch 노드의 global index가 되감기지 않는다.
+	t.truncateAfterLocked(b.base, baseRef, baseEpoch)
+	t.versions.rootsMu.Lock()
+	for i, ref := range b.versions {
+		t.versions.versionRoots[b.base+1+uint64(i)] = ref
+	}
+	t.versions.rootsMu.Unlock()
+	if b.epoch != nil {
+		t.memory.activeEpoch = b.epoch
+	}
+	t.dropBranchLocked(name, b)
+	t.reclaimLocked()
+
+	return *snapshot, nil
+}
+
+// Abandon discards the branch. Its epochs are recycled once no reader holds
+// one of its heads.
+func (t *StateTree) Abandon(name string) error {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	b, ok := t.versions.branches[name]
+	if !ok {
+		return ErrUnknownBranch
+	}
+	for _, ref := range b.versions {
+		if cnt, ok := t.versions.epochRefcount[ref.epochID]; ok {
+			cnt--
+			t.versions.epochRefcount[ref.epochID] = cnt
+			if cnt == 0 {
+				t.versions.orphanEpochs = append(t.versions.orphanEpochs, ref.epochID)
+			}
+		}
+	}
+	t.dropBranchLocked(name, b)
+	t.reclaimLocked()
+	return nil
+}
+
+func (t *StateTree) dropBranchLocked(name string, b *branch) {
+	delete(t.versions.branches, name)
+	if t.versions.pinned[b.base]--; t.versions.pinned[b.base] <= 0 {
+		delete(t.versions.pinned, b.base)
+	}
+}
+
+// pinnedAfterLocked reports whether a branch was forked from a version newer
+// than version.
+func (t *StateTree) pinnedAfterLocked(version uint64) bool {
+	for v := range t.versions.pinned {
+		if v > version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,339 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"iter"
+)
+
+// BulkLoad builds the tree from entries, which must yield exactly count
+// distinct keys in strictly ascending order, and publishes them as a single
+// version. The latest version must be empty. The stream is read once into the
+// level buffer, which also counts the internal nodes the keys' shared
+// prefixes need, so one epoch is sized exactly before anything is written.
+// Leaves are then written in stream order and folded into their parents on a
+// stack as the shared prefix with the next key shrinks, with no path walks.
+//
+// If expectedRoot is not nil the finished root must equal it. On any error
+// nothing is published and everything written is handed back.
+func (t *StateTree) BulkLoad(entries iter.Seq2[[32]byte, [32]byte], count int, expectedRoot *[32]byte) (Snapshot, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if t.updater.staged != nil {
+		return Snapshot{}, ErrStagePending
+	}
+	current := t.versions.latest.Load()
+	if current == nil {
+		return Snapshot{}, ErrUnknownVersion
+	}
+	if current.RootIndex != 0 {
+		return Snapshot{}, ErrTreeNotEmpty
+	}
+	if count < 0 {
+		return Snapshot{}, ErrBulkCount
+	}
+	// 복원용 level buffer는 count만큼 커지므로 끝나면 놓아 준다.
+	defer func() { t.updater.builder.levelBuf = levelBuffer{} }()
+
+	version := current.Version + 1
+	var (
+		walMark int64
+		walErr  error
+	)
+	if t.wal != nil {
+		// 입력은 한 번만 읽을 수 있으므로 지나가는 entry를 part record로 나눠 기록해 둔다.
+		walMark = t.wal.size
+		seq, n := uint32(0), uint32(0)
+		t.wal.buf = appendBulkPartHeader(t.wal.buf[:0], version)
+		source := entries
+		entries = func(yield func([32]byte, [32]byte) bool) {
+			for key, value := range source {
+				m := Mutation{Key: key, Value: value}
+				t.wal.buf = appendWALMutation(t.wal.buf, &m)
+				n++
+				if len(t.wal.buf) >= walBulkChunkSize {
+					binary.LittleEndian.PutUint32(t.wal.buf[walHeaderSize:], seq)
+					binary.LittleEndian.PutUint32(t.wal.buf[walHeaderSize+4:], n)
+					if walErr = t.wal.append(t.wal.buf); walErr != nil {
+						return
+					}
+					seq, n = seq+1, 0
+					t.wal.buf = appendBulkPartHeader(t.wal.buf[:0], version)
+				}
+				if !yield(key, value) {
+					return
+				}
+			}
+			t.wal.buf[0] = walBulk
+			binary.LittleEndian.PutUint32(t.wal.buf[walHeaderSize:], seq)
+			binary.LittleEndian.PutUint32(t.wal.buf[walHeaderSize+4:], n)
+		}
+	}
+	values, requiredNodes, err := t.readSorted(entries, count)
+	if walErr != nil {
+		err = walErr
+	}
+	if err != nil {
+		t.rewindWALLocked(walMark)
+		return Snapshot{}, err
+	}
+	undo, err := t.beginBatchLocked(&t.memory.activeEpoch, requiredNodes)
+	if err != nil {
+		t.rewindWALLocked(walMark)
+		return Snapshot{}, err
+	}
+	rootIndex, rootHash, err := t.buildSorted(undo.epoch, values, version, requiredNodes)
+	if err == nil {
+		err = t.memory.store.Err()
+	}
+	if err == nil && expectedRoot != nil && *expectedRoot != rootHash {
+		err = ErrRootMismatch
+	}
+	if err == nil && t.wal != nil {
+		copy(t.wal.buf[9:walHeaderSize], rootHash[:])
+		err = t.logLocked()
+	}
+	if err != nil {
+		t.rewindWALLocked(walMark)
+		undo.undo(t)
+		return Snapshot{}, err
+	}
+
+	epoch := undo.epoch
+	t.recordIndicesLocked(epoch.ID(), undo.locator, t.memory.nextLocator)
+	return t.publishLocked(version, rootRef{
+		epochID:     epoch.ID(),
+		rootIndex:   rootIndex,
+		rootHash:    rootHash,
+		head:        epoch.Head(),
+		blobs:       epoch.BlobMark(),
+		nextLocator: t.memory.nextLocator,
+		locatorEnd:  t.memory.locatorEnd,
+	}), nil
+}
+
+// readSorted reads entries into the level buffer and returns their values
+// and the number of nodes the tree needs: a leaf per key and an internal node
+// per prefix that two or more keys share. In sorted order every such prefix
+// is shared by some adjacent pair, so the count is exact. The buffers grow
+// with the stream and never past count, so a count the stream does not
+// back allocates nothing up front.
+func (t *StateTree) readSorted(entries iter.Seq2[[32]byte, [32]byte], count int) ([][32]byte, int, error) {
+	b := &t.updater.builder
+	curr := b.levelBuf.curr[:0]
+	var values [][32]byte
+	internal, prevShared := 0, 0
+	for key, value := range entries {
+		if len(curr) == count {
+			return nil, 0, ErrBulkCount
+		}
+		if len(curr) > 0 {
+			prev := curr[len(curr)-1].key
+			if bytes.Compare(prev[:], key[:]) >= 0 {
+				return nil, 0, ErrUnsortedInput
+			}
+			// 두 key가 공유하는 prefix마다 노드가 하나씩 있다. 앞 쌍과 겹치는 prefix는 이미 셌다.
+			shared := t.splitDepth(prev, key) + 1
+			internal += shared - min(shared, prevShared)
+			prevShared = shared
+		}
+		curr = growCapped(curr, count)
+		values = growCapped(values, count)
+		curr = append(curr, levelEntry{key: key, leaf: true})
+		values = append(values, value)
+	}
+	b.levelBuf.curr = curr
+	if len(curr) != count {
+		return nil, 0, ErrBulkCount
+	}
+	if count+internal > int(maxNodeIndex)-1 {
+		return nil, 0, ErrNodeIndexExhaust
+	}
+	return values, count + internal, nil
+}
+
+// growCapped makes room for one more element, doubling up to limit.
+func growCapped[E any](s []E, limit int) []E {
+	if len(s) < cap(s) {
+		return s
+	}
+	grown := make([]E, len(s), min(max(2*len(s), 1024), limit))
+	copy(grown, s)
+	return grown
+}
+
+// splitDepth returns the depth, in the tree's layout, of the internal node
+// where the paths of two distinct keys part.
+//
+//go:inline
+func (t *StateTree) splitDepth(a, b [32]byte) int {
+	shared := commonPrefixBits(a, b)
+	if t.radix16 {
+		return shared / 4
+	}
+	return shared
+}
+
+// bulkFrame is a finished subtree waiting on buildSorted's stack for the
+// subtrees right of it.
+type bulkFrame struct {
+	key   [32]byte // a key under the subtree
+	hash  [32]byte
+	index uint32
+	// depth is the root's depth in the tree's layout; leaves float and
+	// ignore it.
+	depth int
+	leaf  bool
+	// split is where the subtree parts from the next frame on the stack.
+	split int
+}
+
+// buildSorted writes a leaf for every entry read by readSorted and folds
+// them up to the root. Frames on the stack split from their right
+// neighbours at strictly deeper depths (or equal ones, for siblings under
+// one node16), so a key that splits from its predecessor at depth d
+// completes every frame split deeper than d. Each node is written once.
+func (t *StateTree) buildSorted(epoch EpochStore, values [][32]byte, version uint64, requiredNodes int) (uint32, [32]byte, error) {
+	region, err := t.carveRegion(epoch, uint32(requiredNodes))
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+	curr := t.updater.builder.levelBuf.curr
+	if len(curr) == 0 {
+		return 0, t.hasher.ZeroHash(0), nil
+	}
+	stack := make([]bulkFrame, 0, 64)
+	for i := range curr {
+		leaf := t.leafNode(curr[i].key, values[i], BlobRef{}, version)
+		index, err := t.allocInRegion(&region, leaf)
+		if err != nil {
+			return 0, [32]byte{}, err
+		}
+		if i > 0 {
+			if stack, err = t.foldFrames(&region, stack, t.splitDepth(curr[i-1].key, curr[i].key), version); err != nil {
+				return 0, [32]byte{}, err
+			}
+		}
+		stack = append(stack, bulkFrame{key: leaf.Key, hash: leaf.Hash, index: index, leaf: true})
+	}
+	stack, err = t.foldFrames(&region, stack, -1, version)
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+	root, err := t.liftFrame(&region, stack[0], 0, version)
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+	t.trimRegion(&region)
+	return root.index, root.hash, nil
+}
+
+// foldFrames merges the frames on top of the stack that split deeper than
+// split into their parents and leaves the result marked with split.
+func (t *StateTree) foldFrames(region *allocRegion, stack []bulkFrame, split int, version uint64) ([]bulkFrame, error) {
+	var group [16]bulkFrame
+	cur := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	for len(stack) > 0 && stack[len(stack)-1].split > split {
+		depth := stack[len(stack)-1].split
+		group[0] = cur
+		n := 1
+		for len(stack) > 0 && stack[len(stack)-1].split == depth {
+			group[n] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			n++
+		}
+		for i := range n {
+			var err error
+			if group[i], err = t.liftFrame(region, group[i], depth+1, version); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if cur, err = t.bulkParent(region, group[:n], depth, version); err != nil {
+			return nil, err
+		}
+	}
+	cur.split = split
+	return append(stack, cur), nil
+}
+
+// liftFrame adds the single-child nodes between an internal frame's root and
+// depth; a leaf moves up on its own.
+func (t *StateTree) liftFrame(region *allocRegion, frame bulkFrame, depth int, version uint64) (bulkFrame, error) {
+	for !frame.leaf && frame.depth > depth {
+		var err error
+		if frame, err = t.bulkParent(region, []bulkFrame{frame}, frame.depth-1, version); err != nil {
+			return bulkFrame{}, err
+		}
+	}
+	return frame, nil
+}
+
+// bulkParent writes the internal node at depth over children, whose roots
+// sit one level below it.
+func (t *StateTree) bulkParent(region *allocRegion, children []bulkFrame, depth int, version uint64) (bulkFrame, error) {
+	parent := bulkFrame{key: children[0].key, depth: depth}
+	var node Node
+	if t.radix16 {
+		var levels [5][16]subtree
+		var n16 node16
+		for i := range children {
+			child := &children[i]
+			slot := nibbleAt(child.key, depth)
+			kind := subtreeInner
+			if child.leaf {
+				kind = subtreeLeaf
+				n16.LeafBitmap |= 1 << slot
+			}
+			levels[4][slot] = subtree{hash: child.hash, index: child.index, kind: kind}
+			n16.Children[slot] = child.index
+			n16.Bitmap |= 1 << slot
+		}
+		t.fold16(&levels, depth)
+		n16.Hash = levels[0][0].hash
+		n16.Version = version
+		n16.Prefix = makePrefix(uint16(4*depth), false) | radix16BitMask
+		node = n16.node()
+	} else {
+		hashes := [2][32]byte{t.hasher.ZeroHash(uint16(depth + 1)), t.hasher.ZeroHash(uint16(depth + 1))}
+		var indices [2]uint32
+		for i := range children {
+			side := bitAt(children[i].key, uint16(depth))
+			hashes[side] = children[i].hash
+			indices[side] = children[i].index
+		}
+		node = Node{
+			Hash:       t.hasher.HashParent(hashes[0], hashes[1]),
+			Version:    version,
+			Prefix:     makePrefix(uint16(depth), false),
+			LeftIndex:  indices[0],
+			RightIndex: indices[1],
+		}
+	}
+	index, err := t.allocInRegion(region, node)
+	if err != nil {
+		return bulkFrame{}, err
+	}
+	parent.hash = node.Hash
+	parent.index = index
+	return parent, nil
+}
+
+// appendBulkPartHeader starts a bulk part record; its sequence number and
+// entry count are filled in when it is written.
+func appendBulkPartHeader(dst []byte, version uint64) []byte {
+	dst = appendWALHeader(dst, walBulkPart, version, [32]byte{})
+	return binary.LittleEndian.AppendUint64(dst, 0)
+}
+
+// rewindWALLocked drops the part records of a bulk load that failed, so the
+// log holds no records of a version that was never published.
+func (t *StateTree) rewindWALLocked(mark int64) {
+	if t.wal != nil {
+		t.wal.rewind(mark)
+	}
+}
@@ -0,0 +1,702 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+	"unsafe"
+
+	"github.com/Pam-La/jmt_for_mac/internal/hash"
+)
+
+// A checkpoint holds the reachable nodes of one version. All integers are
+// little-endian.
+//
+//	header  magic "JMTCKPT\x00" | format u32 | scheme u8 | radix u8 | kind u8 |
+//	        0 u8 | hash key [32] | version u64 | root [32] | nodes u64
+//	delta   incremental only: base version u64 | refs u64 |
+//	        refs x (hash [32] | path [32])
+//	nodes   one record per node in post-order, so children precede parents
+//	        and the root comes last
+//	trailer crc32c of everything before it, u32
+//
+// A record is the node's 128-byte in-memory layout with its child indices
+// renumbered densely from 1 in record order. Its blob field is {1, 0} when
+// the leaf's original key and value follow as keyLen u32 | valueLen u32 |
+// key | value, and zero otherwise.
+//
+// An incremental checkpoint writes only the nodes whose Version is newer
+// than its base. A child it does not write is checkpointRef | k, the k-th
+// reference of the delta section, and names a node of the base by its hash
+// and a path to it: a leaf's key, or an internal node's prefix. The loader
+// walks the base version's tree along the path until it meets the hash. When
+// no node is newer, the root is the single reference.
+const (
+	checkpointFormat     = 1
+	checkpointHeaderSize = 8 + 4 + 4 + 32 + 8 + 32 + 8
+	checkpointDeltaSize  = 8 + 8
+)
+
+const (
+	checkpointFull byte = iota
+	checkpointIncremental
+)
+
+// checkpointRef marks a child that references a base node.
+const checkpointRef = uint32(1) << 31
+
+var checkpointMagic = [8]byte{'J', 'M', 'T', 'C', 'K', 'P', 'T', 0}
+
+// checkpointBlob marks a record followed by its blob.
+var checkpointBlob = BlobRef{Chunk: 1}
+
+type checkpointHeader struct {
+	scheme  hash.Scheme
+	radix   uint8
+	hashKey [32]byte
+	version uint64
+	root    [32]byte
+	nodes   uint64
+	// base is 0 for a full checkpoint.
+	base uint64
+	refs uint64
+}
+
+func (h *checkpointHeader) encode() []byte {
+	b := make([]byte, checkpointHeaderSize, checkpointHeaderSize+checkpointDeltaSize)
+	copy(b[0:], checkpointMagic[:])
+	binary.LittleEndian.PutUint32(b[8:], checkpointFormat)
+	b[12] = byte(h.scheme)
+	b[13] = h.radix
+	copy(b[16:], h.hashKey[:])
+	binary.LittleEndian.PutUint64(b[48:], h.version)
+	copy(b[56:], h.root[:])
+	binary.LittleEndian.PutUint64(b[88:], h.nodes)
+	if h.base == 0 {
+		return b
+	}
+	b[14] = checkpointIncremental
+	b = binary.LittleEndian.AppendUint64(b, h.base)
+	return binary.LittleEndian.AppendUint64(b, h.refs)
+}
+
+func readCheckpointHeader(r io.Reader) (checkpointHeader, error) {
+	var b [checkpointHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return checkpointHeader{}, err
+	}
+	if [8]byte(b[0:8]) != checkpointMagic || binary.LittleEndian.Uint32(b[8:]) != checkpointFormat {
+		return checkpointHeader{}, ErrCheckpointFormat
+	}
+	h := checkpointHeader{
+		scheme:  hash.Scheme(b[12]),
+		radix:   b[13],
+		hashKey: [32]byte(b[16:48]),
+		version: binary.LittleEndian.Uint64(b[48:]),
+		root:    [32]byte(b[56:88]),
+		nodes:   binary.LittleEndian.Uint64(b[88:]),
+	}
+	if (h.radix != 2 && h.radix != 16) || b[14] > checkpointIncremental || b[15] != 0 {
+		return checkpointHeader{}, ErrCheckpointFormat
+	}
+	if b[14] == checkpointIncremental {
+		var d [checkpointDeltaSize]byte
+		if _, err := io.ReadFull(r, d[:]); err != nil {
+			return checkpointHeader{}, ErrCheckpointFormat
+		}
+		h.base = binary.LittleEndian.Uint64(d[0:])
+		h.refs = binary.LittleEndian.Uint64(d[8:])
+		if h.base == 0 || h.base >= h.version {
+			return checkpointHeader{}, ErrCheckpointFormat
+		}
+	}
+	if h.nodes >= uint64(checkpointRef) {
+		return checkpointHeader{}, ErrNodeIndexExhaust
+	}
+	// 참조는 기록된 노드의 자식 칸마다 많아야 하나다.
+	if h.refs > max(uint64(h.radix)*h.nodes, 1) || h.version == 0 && h.nodes+h.refs > 0 {
+		return checkpointHeader{}, ErrCheckpointFormat
+	}
+	return h, nil
+}
+
+//go:inline
+func nodeBytes(node *Node) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(node)), NodeSize)
+}
+
+// WriteCheckpoint writes the tree of a retained version to w. It reads
+// through a read transaction, so commits go on while it runs. Loading the
+// checkpoint needs the same hash scheme and key; a custom Config.Hasher is
+// recorded only by its scheme.
+func (t *StateTree) WriteCheckpoint(w io.Writer, version uint64) error {
+	return t.writeCheckpoint(w, 0, version)
+}
+
+// WriteIncrementalCheckpoint writes the nodes of a retained version that are
+// newer than base, the version of an earlier checkpoint, and references the
+// rest by hash. base need not be retained, but it must lie on version's
+// history: after a Rollback past base, the old base checkpoint no longer
+// holds the nodes this one references.
+func (t *StateTree) WriteIncrementalCheckpoint(w io.Writer, base, version uint64) error {
+	if base == 0 || base >= version {
+		return ErrCheckpointBase
+	}
+	return t.writeCheckpoint(w, base, version)
+}
+
+func (t *StateTree) writeCheckpoint(w io.Writer, base, version uint64) error {
+	txn, err := t.AcquireVersion(version)
+	if err != nil {
+		return err
+	}
+	defer txn.Release()
+
+	radix := uint8(2)
+	if t.radix16 {
+		radix = 16
+	}
+	root := txn.snapshot.RootIndex
+	cw := checkpointWriter{tree: t, base: base}
+	if root != 0 {
+		cw.scan(root, [32]byte{})
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	header := checkpointHeader{
+		scheme:  t.hasher.Scheme(),
+		radix:   radix,
+		hashKey: t.hashKey,
+		version: version,
+		root:    txn.snapshot.RootHash,
+		nodes:   uint64(cw.nodes),
+		base:    base,
+		refs:    uint64(len(cw.refs)),
+	}
+
+	crc := crc32.New(crc32cTable)
+	bw := bufio.NewWriter(w)
+	cw.w = io.MultiWriter(bw, crc)
+	cw.write(header.encode())
+	for i := range cw.refs {
+		cw.write(cw.refs[i].hash[:])
+		cw.write(cw.refs[i].path[:])
+	}
+	if root != 0 {
+		cw.writeNode(root)
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	if err := t.memory.store.Err(); err != nil {
+		return err
+	}
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc.Sum32())
+	if _, err := bw.Write(trailer[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type checkpointWriter struct {
+	tree *StateTree
+	w    io.Writer
+	// Nodes with Version at or below base are referenced, not written.
+	base  uint64
+	nodes uint32
+	refs  []checkpointBaseRef
+	// next and ref are the dense numbers of the last record and reference
+	// written.
+	next uint32
+	ref  uint32
+	err  error
+	buf  [8]byte
+	blob []byte
+}
+
+func (cw *checkpointWriter) write(b []byte) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(b)
+	}
+}
+
+// checkpointBaseRef is a node of the base checkpoint and a path to it.
+type checkpointBaseRef struct {
+	hash [32]byte
+	path [32]byte
+}
+
+// scan counts the records under index, whose prefix is path, and collects
+// the base nodes they reference in the order writeNode meets them. Within
+// one tree every node has a single parent.
+func (cw *checkpointWriter) scan(index uint32, path [32]byte) {
+	node, _, ok := cw.tree.nodeByIndex(index)
+	if !ok {
+		cw.err = ErrCheckpointFormat
+		return
+	}
+	if node.Version <= cw.base {
+		// leaf는 base에서 더 깊이 있었을 수 있으므로 key 전체를 따라간다.
+		if isLeaf(node.Prefix) {
+			path = node.Key
+		}
+		cw.refs = append(cw.refs, checkpointBaseRef{hash: node.Hash, path: path})
+		return
+	}
+	cw.nodes++
+	var children [16]uint32
+	width := childSlots(&node, &children)
+	for s := 0; s < width; s++ {
+		if children[s] != 0 {
+			cw.scan(children[s], childPath(&node, path, s))
+		}
+	}
+}
+
+// childPath returns the prefix of the child in slot s of node, whose prefix
+// is path.
+func childPath(node *Node, path [32]byte, s int) [32]byte {
+	depth := int(decodeDepth(node.Prefix))
+	if isRadix16(node.Prefix) {
+		shift := 4 * (1 - depth/4%2)
+		path[depth/8] |= byte(s) << shift
+		return path
+	}
+	path[depth/8] |= byte(s) << (7 - depth%8)
+	return path
+}
+
+// writeNode writes the subtree at index in post-order and returns the dense
+// number of its root, or its reference.
+func (cw *checkpointWriter) writeNode(index uint32) uint32 {
+	node, epoch, ok := cw.tree.nodeByIndex(index)
+	if !ok {
+		cw.err = ErrCheckpointFormat
+		return 0
+	}
+	if node.Version <= cw.base {
+		cw.ref++
+		return checkpointRef | cw.ref
+	}
+	var children [16]uint32
+	width := childSlots(&node, &children)
+	for s := 0; s < width; s++ {
+		if children[s] != 0 {
+			children[s] = cw.writeNode(children[s])
+		}
+	}
+	setChildSlots(&node, &children)
+
+	// node16의 Children은 Blob 자리와 겹치므로 leaf만 본다.
+	var key, value []byte
+	blob := isLeaf(node.Prefix) && node.Blob.valid()
+	if blob {
+		key, value, ok = epoch.Blob(node.Blob, &cw.blob)
+		if !ok {
+			cw.err = ErrCheckpointFormat
+			return 0
+		}
+		node.Blob = checkpointBlob
+	}
+	cw.write(nodeBytes(&node))
+	if blob {
+		binary.LittleEndian.PutUint32(cw.buf[0:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(cw.buf[4:], uint32(len(value)))
+		cw.write(cw.buf[:])
+		cw.write(key)
+		cw.write(value)
+	}
+	cw.next++
+	return cw.next
+}
+
+// setChildSlots is the inverse of childSlots.
+func setChildSlots(node *Node, children *[16]uint32) {
+	switch {
+	case isLeaf(node.Prefix):
+	case isRadix16(node.Prefix):
+		asNode16(node).Children = *children
+	default:
+		node.LeftIndex, node.RightIndex = children[0], children[1]
+	}
+}
+
+// checkpointReader reads one checkpoint and checksums what it reads.
+type checkpointReader struct {
+	header checkpointHeader
+	br     *bufio.Reader
+	tr     io.Reader
+	crc    hash32
+}
+
+// hash32 is the part of hash.Hash32 the loader needs.
+type hash32 interface {
+	io.Writer
+	Sum32() uint32
+}
+
+func openCheckpoint(r io.Reader) (*checkpointReader, error) {
+	cr := &checkpointReader{br: bufio.NewReader(r), crc: crc32.New(crc32cTable)}
+	cr.tr = io.TeeReader(cr.br, cr.crc)
+	header, err := readCheckpointHeader(cr.tr)
+	if err != nil {
+		return nil, err
+	}
+	cr.header = header
+	return cr, nil
+}
+
+// LoadCheckpoint builds a tree from a full checkpoint followed by any number
+// of incremental ones, each based on the version of the one before it. Every
+// checkpoint's version is published in turn, so the last is the latest and
+// RetainVersions decides which earlier ones stay readable. The hash scheme,
+// key and radix come from the checkpoints and override cfg; a cfg.Hasher
+// must use the same scheme. The full checkpoint goes into a single epoch
+// with consecutive global indices. Every node's hash is checked against its
+// children, and its place against the path to it, before each root is
+// compared with its header.
+func LoadCheckpoint(r io.Reader, cfg Config, deltas ...io.Reader) (*StateTree, error) {
+	if cfg.WALPath != "" {
+		return nil, ErrWALPath
+	}
+	return loadCheckpoint(r, cfg, deltas)
+}
+
+// loadCheckpoint is LoadCheckpoint for Recover, which opens cfg.WALPath.
+func loadCheckpoint(r io.Reader, cfg Config, deltas []io.Reader) (*StateTree, error) {
+	cr, err := openCheckpoint(r)
+	if err != nil {
+		return nil, err
+	}
+	header := &cr.header
+	if header.base != 0 {
+		return nil, ErrCheckpointBase
+	}
+	if cfg.Hasher != nil && cfg.Hasher.Scheme() != header.scheme {
+		return nil, ErrCheckpointFormat
+	}
+	cfg.HashScheme, cfg.HashKey, cfg.Radix = header.scheme, header.hashKey, int(header.radix)
+	if cfg.Hasher == nil {
+		// 잘못된 scheme 값은 NewStateTree가 panic하기 전에 걸러 낸다.
+		if _, err := hash.New(header.scheme, header.hashKey); err != nil {
+			return nil, ErrCheckpointFormat
+		}
+	}
+
+	t := newStateTree(cfg)
+	if err := t.loadCheckpoints(cr, deltas); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadCheckpoints loads cr and then each delta, checking that it continues
+// the checkpoint before it.
+func (t *StateTree) loadCheckpoints(cr *checkpointReader, deltas []io.Reader) error {
+	for i := 0; ; i++ {
+		t.writerMu.Lock()
+		err := t.loadCheckpointLocked(cr)
+		t.writerMu.Unlock()
+		if err != nil || i == len(deltas) {
+			return err
+		}
+		next, err := openCheckpoint(deltas[i])
+		if err != nil {
+			return err
+		}
+		prev, h := &cr.header, &next.header
+		if h.base != prev.version || h.scheme != prev.scheme || h.radix != prev.radix || h.hashKey != prev.hashKey {
+			return ErrCheckpointBase
+		}
+		cr = next
+	}
+}
+
+// loadCheckpointLocked adds one checkpoint to t and publishes its version.
+// On error the caller closes t, so nothing written here is undone.
+func (t *StateTree) loadCheckpointLocked(cr *checkpointReader) error {
+	header := &cr.header
+	refs, err := t.readCheckpointRefs(cr.tr, header.refs)
+	if err != nil {
+		return err
+	}
+	n := uint32(header.nodes)
+	ref := rootRef{rootHash: t.hasher.ZeroHash(0)}
+	epoch := t.memory.activeEpoch
+	minVersion := header.version
+	switch {
+	case n > 0:
+		undo, err := t.beginBatchLocked(&t.memory.activeEpoch, int(n))
+		if err != nil {
+			return err
+		}
+		epoch = undo.epoch
+		if ref, minVersion, err = t.readCheckpointNodes(cr.tr, epoch, header, refs); err != nil {
+			return err
+		}
+		t.recordIndicesLocked(epoch.ID(), undo.locator, t.memory.nextLocator)
+	case len(refs) == 1:
+		node, _, _ := t.nodeByIndex(refs[0])
+		ref.rootIndex, ref.rootHash = refs[0], node.Hash
+	}
+
+	sum := cr.crc.Sum32()
+	var stored [4]byte
+	if _, err := io.ReadFull(cr.br, stored[:]); err != nil || binary.LittleEndian.Uint32(stored[:]) != sum {
+		return ErrCheckpointChecksum
+	}
+	if ref.rootHash != header.root {
+		return ErrRootMismatch
+	}
+	if header.version == 0 {
+		return nil
+	}
+
+	// 불러온 노드는 원래 버전을 지니므로 floor를 그중 가장 오래된 것으로 둔다.
+	if floor, ok := t.versions.epochFloor[epoch.ID()]; !ok || minVersion < floor {
+		t.versions.epochFloor[epoch.ID()] = minVersion
+	}
+	ref.epochID = epoch.ID()
+	ref.head = epoch.Head()
+	ref.blobs = epoch.BlobMark()
+	ref.nextLocator = t.memory.nextLocator
+	ref.locatorEnd = t.memory.locatorEnd
+	t.publishLocked(header.version, ref)
+	return nil
+}
+
+// readCheckpointRefs resolves the references of the delta section to the
+// global indices of nodes in the latest version, the delta's base.
+func (t *StateTree) readCheckpointRefs(r io.Reader, count uint64) ([]uint32, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	root := t.versions.latest.Load().RootIndex
+	refs := make([]uint32, count)
+	resolved := make(map[uint32]struct{}, count)
+	var ref checkpointBaseRef
+	for i := range refs {
+		if _, err := io.ReadFull(r, ref.hash[:]); err != nil {
+			return nil, ErrCheckpointFormat
+		}
+		if _, err := io.ReadFull(r, ref.path[:]); err != nil {
+			return nil, ErrCheckpointFormat
+		}
+		index, ok := t.findCheckpointRef(root, &ref)
+		if !ok {
+			return nil, ErrCheckpointBase
+		}
+		// 한 트리에서 노드의 부모는 하나뿐이므로 두 reference가 같은 노드를 가리킬 수 없다.
+		if _, dup := resolved[index]; dup {
+			return nil, ErrCheckpointFormat
+		}
+		resolved[index] = struct{}{}
+		refs[i] = index
+	}
+	return refs, nil
+}
+
+// findCheckpointRef walks from root along ref's path to the node with ref's
+// hash.
+func (t *StateTree) findCheckpointRef(root uint32, ref *checkpointBaseRef) (uint32, bool) {
+	for current := root; current != 0; {
+		node, _, ok := t.nodeByIndex(current)
+		if !ok {
+			return 0, false
+		}
+		if node.Hash == ref.hash {
+			return current, true
+		}
+		if isLeaf(node.Prefix) {
+			return 0, false
+		}
+		depth := decodeDepth(node.Prefix)
+		switch {
+		case isRadix16(node.Prefix):
+			current = asNode16(&node).Children[nibbleAt(ref.path, int(depth)/4)]
+		case bitAt(ref.path, depth) == 0:
+			current = node.LeftIndex
+		default:
+			current = node.RightIndex
+		}
+	}
+	return 0, false
+}
+
+// readCheckpointNodes stores the records into epoch and checks each node's
+// hash, that no record or reference is the child of two nodes, and that
+// every node sits where its path from the root puts it. It returns the
+// root's rootRef fields and the oldest node version.
+func (t *StateTree) readCheckpointNodes(r io.Reader, epoch EpochStore, header *checkpointHeader, refs []uint32) (rootRef, uint64, error) {
+	n := uint32(header.nodes)
+	region, err := t.carveRegion(epoch, n)
+	if err != nil {
+		return rootRef{}, 0, err
+	}
+	base := region.nextID
+	minVersion := header.version
+	var (
+		node     Node
+		children [16]uint32
+		lengths  [8]byte
+		blob     []byte
+		scratch  []byte
+		// used[c]는 record c나 reference c가 이미 누군가의 자식인지다.
+		used     = make([]bool, n+1)
+		usedRefs = make([]bool, len(refs)+1)
+	)
+	for i := uint32(1); i <= n; i++ {
+		if _, err := io.ReadFull(r, nodeBytes(&node)); err != nil {
+			return rootRef{}, 0, ErrCheckpointFormat
+		}
+		if node.Version > header.version || node.Version <= header.base {
+			return rootRef{}, 0, ErrCheckpointFormat
+		}
+		minVersion = min(minVersion, node.Version)
+		width := childSlots(&node, &children)
+		for s := 0; s < width; s++ {
+			c := children[s]
+			switch {
+			case c == 0:
+			case c&checkpointRef != 0:
+				k := c &^ checkpointRef
+				if k == 0 || k > uint32(len(refs)) || usedRefs[k] {
+					return rootRef{}, 0, ErrCheckpointFormat
+				}
+				usedRefs[k] = true
+				children[s] = refs[k-1]
+			case c < i && !used[c]:
+				used[c] = true
+				children[s] = base + c - 1
+			default:
+				return rootRef{}, 0, ErrCheckpointFormat
+			}
+		}
+		setChildSlots(&node, &children)
+
+		if isLeaf(node.Prefix) {
+			switch node.Blob {
+			case BlobRef{}:
+			case checkpointBlob:
+				if _, err := io.ReadFull(r, lengths[:]); err != nil {
+					return rootRef{}, 0, ErrCheckpointFormat
+				}
+				keyLen := uint64(binary.LittleEndian.Uint32(lengths[0:]))
+				valueLen := uint64(binary.LittleEndian.Uint32(lengths[4:]))
+				if keyLen+valueLen > math.MaxUint32 {
+					return rootRef{}, 0, ErrBlobTooLarge
+				}
+				blob = slices.Grow(blob[:0], int(keyLen+valueLen))[:keyLen+valueLen]
+				if _, err := io.ReadFull(r, blob); err != nil {
+					return rootRef{}, 0, ErrCheckpointFormat
+				}
+				if node.Blob, err = epoch.AppendBlob(blob[:keyLen], blob[keyLen:]); err != nil {
+					return rootRef{}, 0, err
+				}
+			default:
+				return rootRef{}, 0, ErrCheckpointFormat
+			}
+		}
+
+		if !t.checkNodeHash(&node, epoch, &scratch) {
+			return rootRef{}, 0, ErrRootMismatch
+		}
+		if _, err := t.allocInRegion(&region, node); err != nil {
+			return rootRef{}, 0, err
+		}
+	}
+	t.trimRegion(&region)
+	root := base + n - 1
+	if !t.checkCheckpointPath(root, 0, [32]byte{}, base, root) {
+		return rootRef{}, 0, ErrCheckpointFormat
+	}
+	return rootRef{rootIndex: root, rootHash: node.Hash}, minVersion, nil
+}
+
+// checkCheckpointPath checks that the node at index sits where the path to
+// it puts it: an internal node at depth, one step below its parent, and a
+// leaf whose key starts with path's first depth bits. Records, the indices
+// first..last, are walked; a base node is already in place in its own tree,
+// so only one of its keys is checked against path.
+func (t *StateTree) checkCheckpointPath(index uint32, depth int, path [32]byte, first, last uint32) bool {
+	node, _, ok := t.nodeByIndex(index)
+	if !ok {
+		return false
+	}
+	if isLeaf(node.Prefix) {
+		return samePrefix(node.Key, path, uint16(depth))
+	}
+	if depth >= JMTTreeDepth || int(decodeDepth(node.Prefix)) != depth || isRadix16(node.Prefix) != t.radix16 {
+		return false
+	}
+	if index < first || index > last {
+		key, ok := t.firstKey(index)
+		return ok && samePrefix(key, path, uint16(depth))
+	}
+	step := 1
+	if t.radix16 {
+		step = 4
+	}
+	var children [16]uint32
+	width := childSlots(&node, &children)
+	for s := 0; s < width; s++ {
+		if children[s] != 0 && !t.checkCheckpointPath(children[s], depth+step, childPath(&node, path, s), first, last) {
+			return false
+		}
+	}
+	return true
+}
+
+// firstKey returns the smallest key under index.
+func (t *StateTree) firstKey(index uint32) ([32]byte, bool) {
+	var children [16]uint32
+	for index != 0 {
+		node, _, ok := t.nodeByIndex(index)
+		if !ok {
+			break
+		}
+		if isLeaf(node.Prefix) {
+			return node.Key, true
+		}
+		width := childSlots(&node, &children)
+		next := uint32(0)
+		for s := 0; s < width && next == 0; s++ {
+			next = children[s]
+		}
+		index = next
+	}
+	return [32]byte{}, false
+}
+
+// checkNodeHash recomputes a node's hash from its key and value or from its
+// children, which must already be stored.
+func (t *StateTree) checkNodeHash(node *Node, epoch EpochStore, scratch *[]byte) bool {
+	if isLeaf(node.Prefix) {
+		if t.hasher.HashLeaf(node.Key, node.Value) != node.Hash {
+			return false
+		}
+		if !node.Blob.valid() {
+			return true
+		}
+		key, value, ok := epoch.Blob(node.Blob, scratch)
+		return ok && t.hasher.HashKey(key) == node.Key && t.hasher.HashValue(value) == node.Value
+	}
+	depth := decodeDepth(node.Prefix)
+	if isRadix16(node.Prefix) {
+		var levels [5][16]subtree
+		t.loadChildren16(asNode16(node), &levels)
+		t.fold16(&levels, int(depth)/4)
+		return levels[0][0].kind == subtreeInner && levels[0][0].hash == node.Hash
+	}
+	left := t.nodeHashAtDepth(node.LeftIndex, depth+1)
+	right := t.nodeHashAtDepth(node.RightIndex, depth+1)
+	return t.hasher.HashParent(left, right) == node.Hash
+}
@@ -0,0 +1,266 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Pam-La/jmt_for_mac/internal/hash"
+)
+
+// commitPartition은 key 상위 splitDepth 비트가 같은 seed 구간이다.
+// 각 파티션은 자기 allocRegion 안에서 splitDepth 깊이의 서브트리 루트까지 만든다.
+type commitPartition struct {
+	lo, hi    int
+	mutations int
+	// nodes bounds the nodes the partition builds.
+	nodes  int
+	region allocRegion
+	root   levelEntry
+	err    error
+}
+
+// commitPool walks the base tree and hashes the levels below splitDepth on
+// several cores. The writer goroutine takes part as worker 0 and merges the
+// partition roots afterwards; the other workers are long-lived goroutines
+// woken twice per batch, once to fill path stacks and once to build.
+type commitPool struct {
+	splitDepth int
+	builders   []levelBuilder
+	wake       []chan struct{}
+	done       sync.WaitGroup
+	next       atomic.Int32
+	closed     bool
+
+	// Job state, written by the writer before waking the workers.
+	tree      *StateTree
+	filling   bool
+	fillChunk int
+	baseRoot  uint32
+	version   uint64
+	mutations []Mutation
+	seeds     []leafSeed
+	stacks    []pathStack
+	parts     [maxCommitPartitions]commitPartition
+	partCount int
+}
+
+// resolveCommitWorkers maps Config.CommitWorkers to a worker count:
+// negative selects GOMAXPROCS, and the result is capped at maxCommitPartitions.
+func resolveCommitWorkers(n int) int {
+	if n < 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > maxCommitPartitions {
+		n = maxCommitPartitions
+	}
+	return n
+}
+
+// newCommitPool starts workers-1 helper goroutines; it returns nil when the
+// commit should stay on the writer goroutine.
+func newCommitPool(hasher hash.Hasher, lanes int, workers int, radix16 bool) *commitPool {
+	if workers < 2 {
+		return nil
+	}
+	partitions := 1
+	for partitions < workers*commitPartitionsPerWorker && partitions < maxCommitPartitions {
+		partitions <<= 1
+	}
+	splitDepth := bits.TrailingZeros(uint(partitions))
+	if radix16 {
+		// 파티션 경계가 node16 경계와 맞아야 한다.
+		splitDepth = (splitDepth + 3) &^ 3
+	}
+
+	p := &commitPool{
+		splitDepth: splitDepth,
+		builders:   make([]levelBuilder, workers-1),
+		wake:       make([]chan struct{}, workers-1),
+	}
+	for i := range p.builders {
+		p.builders[i].router = newSIMDRouter(hasher, lanes)
+		p.wake[i] = make(chan struct{}, 1)
+		go p.run(&p.builders[i], p.wake[i])
+	}
+	return p
+}
+
+func (p *commitPool) run(b *levelBuilder, wake <-chan struct{}) {
+	for range wake {
+		p.drain(b)
+		p.done.Done()
+	}
+}
+
+// drain claims fill chunks or partitions until none are left. Partitions
+// are claimed dynamically, but their regions were carved up front so the
+// layout of the arena does not depend on scheduling.
+func (p *commitPool) drain(b *levelBuilder) {
+	for {
+		i := int(p.next.Add(1)) - 1
+		if p.filling {
+			lo := i * p.fillChunk
+			if lo >= len(p.mutations) {
+				return
+			}
+			hi := min(lo+p.fillChunk, len(p.mutations))
+			for j := lo; j < hi; j++ {
+				fillPathStack(p.tree, p.baseRoot, p.mutations[j].Key, &p.stacks[j])
+			}
+			continue
+		}
+		if i >= p.partCount {
+			return
+		}
+		part := &p.parts[i]
+		part.err = p.build(b, part)
+	}
+}
+
+func (p *commitPool) build(b *levelBuilder, part *commitPartition) error {
+	if err := b.loadLeaves(p.tree, &part.region, p.seeds[part.lo:part.hi], p.mutations, p.version); err != nil {
+		return err
+	}
+	if err := b.mergeDepths(p.tree, &part.region, p.stacks, p.version, JMTTreeDepth-1, p.splitDepth); err != nil {
+		return err
+	}
+	part.root = b.levelBuf.curr[0]
+	return nil
+}
+
+// runPhase wakes the workers, drains alongside them and waits.
+func (p *commitPool) runPhase(writer *levelBuilder) {
+	p.next.Store(0)
+	p.done.Add(len(p.wake))
+	for i := range p.wake {
+		p.wake[i] <- struct{}{}
+	}
+	p.drain(writer)
+	p.done.Wait()
+}
+
+// fill walks the base tree for every mutation in parallel.
+func (p *commitPool) fill(t *StateTree, baseRoot uint32, mutations []Mutation, stacks []pathStack) {
+	chunks := (len(p.wake) + 1) * commitPartitionsPerWorker
+	p.tree = t
+	p.filling = true
+	p.fillChunk = (len(mutations) + chunks - 1) / chunks
+	p.baseRoot = baseRoot
+	p.mutations = mutations
+	p.stacks = stacks
+	p.runPhase(nil)
+	p.filling = false
+	p.tree = nil
+	p.mutations = nil
+	p.stacks = nil
+}
+
+// partition splits the sorted seeds into runs sharing the top splitDepth
+// key bits and bounds the nodes each run builds: a leaf per written key and
+// an internal node per prefix on a seed's path below splitDepth; displaced
+// leaves keep their node. A seed's path
+// goes down to where it parts from both neighbours or, if deeper, to where
+// its walk of the base tree stopped, and the prefixes it shares with the
+// previous seed were already counted. Empty partitions are skipped.
+func (p *commitPool) partition(t *StateTree, seeds []leafSeed, mutations []Mutation, stacks []pathStack) {
+	shift := 8 - p.splitDepth
+	split := p.splitDepth
+	if t.radix16 {
+		split /= 4
+	}
+	p.partCount = 0
+	for lo := 0; lo < len(seeds); {
+		top := seeds[lo].key[0] >> shift
+		hi := lo
+		written, nodes := 0, 0
+		// 앞 seed와 함께 쓰는 경로는 그 seed가 이미 셌다. 파티션의 첫 seed는 split부터 센다.
+		from := split
+		for hi < len(seeds) && seeds[hi].key[0]>>shift == top {
+			if seeds[hi].leaf == 0 {
+				written++
+				if !mutations[seeds[hi].witness].Delete {
+					nodes++
+				}
+			}
+			next := 0
+			if hi+1 < len(seeds) {
+				next = t.splitDepth(seeds[hi].key, seeds[hi+1].key) + 1
+			}
+			depth := max(int(stackAt(stacks, seeds[hi].witness).depth), from, next)
+			nodes += depth - from
+			from = max(split, next)
+			hi++
+		}
+		p.parts[p.partCount] = commitPartition{lo: lo, hi: hi, mutations: written, nodes: nodes}
+		p.partCount++
+		lo = hi
+	}
+}
+
+// apply is the parallel counterpart of the serial applyDirtyPaths body and
+// runs after fill. writer is the updater's own builder; it helps with the
+// partitions and then merges their roots from splitDepth-1 up to the root.
+func (p *commitPool) apply(t *StateTree, writer *levelBuilder, epoch EpochStore, version uint64, seeds []leafSeed, mutations []Mutation, stacks []pathStack, perMutation int) (uint32, [32]byte, error) {
+	p.partition(t, seeds, mutations, stacks)
+
+	for i := 0; i < p.partCount; i++ {
+		part := &p.parts[i]
+		// 앞 파티션의 남는 slot은 돌려받지 못하므로 경로로 센 만큼만 잡는다.
+		// 예약한 locator를 넘지 않도록 mutation당 추정치로 자른다.
+		region, err := t.carveRegion(epoch, uint32(min(part.nodes, part.mutations*perMutation)))
+		if err != nil {
+			return 0, [32]byte{}, err
+		}
+		part.region = region
+	}
+	top, err := t.carveRegion(epoch, uint32(1)<<p.splitDepth)
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+
+	p.tree = t
+	p.version = version
+	p.mutations = mutations
+	p.seeds = seeds
+	p.stacks = stacks
+	p.runPhase(writer)
+	p.tree = nil
+	p.mutations = nil
+	p.seeds = nil
+	p.stacks = nil
+
+	writer.levelBuf.ensure(p.partCount)
+	curr := writer.levelBuf.curr
+	for i := 0; i < p.partCount; i++ {
+		if p.parts[i].err != nil {
+			return 0, [32]byte{}, p.parts[i].err
+		}
+		curr = append(curr, p.parts[i].root)
+	}
+	writer.levelBuf.curr = curr
+
+	if err := writer.mergeDepths(t, &top, stacks, version, p.splitDepth-1, 0); err != nil {
+		return 0, [32]byte{}, err
+	}
+	t.trimRegion(&top)
+	// 뒤에서부터 돌려주면 비어 있는 꼬리가 이어질 때 current run까지 되감긴다.
+	for i := p.partCount - 1; i >= 0; i-- {
+		t.trimRegion(&p.parts[i].region)
+	}
+	rootIndex, rootHash := writer.root(t)
+	return rootIndex, rootHash, nil
+}
+
+func (p *commitPool) close() {
+	if p == nil || p.closed {
+		return
+	}
+	p.closed = true
+	for i := range p.wake {
+		close(p.wake[i])
+	}
+}
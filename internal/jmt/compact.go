@@ -0,0 +1,222 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CompactStats reports one compaction pass. BytesReclaimed is the node
+// capacity of the released arenas minus that of the arena their live nodes
+// moved to; the released arenas are recycled once no reader that entered
+// before the pass is open.
+type CompactStats struct {
+	Epochs         int
+	NodesMoved     int
+	BytesReclaimed int64
+}
+
+// Compact moves the live nodes of sparsely used epochs into one fresh arena
+// and releases the old arenas. Only epochs without versions are moved: they
+// are pinned by nodes that newer trees still share, and at most
+// 1/compactMaxLiveFraction of their capacity is live. A pass runs only when
+// it merges at least two such epochs into a smaller arena. Nodes keep their
+// global index; only their locator entries are repointed, so trees, proofs
+// and open readers are unaffected. Epochs are moved whole, and no further
+// epoch is started once budget has elapsed.
+//
+// Commits also run an unbounded pass whenever compactPinnedEpochs more
+// epochs have been left pinned since the last one, so calling Compact is
+// only needed to reclaim space sooner or in smaller steps.
+func (t *StateTree) Compact(budget time.Duration) (CompactStats, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	stats, err := t.compactLocked(time.Now().Add(budget))
+	t.reclaimLocked()
+	return stats, err
+}
+
+// compactLocked is Compact without the final reclaimLocked, which recycles
+// the released arenas once no reader can reach them. A zero deadline moves
+// every eligible epoch.
+func (t *StateTree) compactLocked(deadline time.Time) (CompactStats, error) {
+	var stats CompactStats
+	if t.memory.epochByID == nil {
+		return stats, nil
+	}
+
+	candidates := t.versions.liveScratch[:0]
+	for _, epochID := range t.versions.orphanEpochs {
+		ep, ok := t.memory.epochByID[epochID]
+		if !ok || ep == t.memory.activeEpoch || epochID == 1 || t.versions.epochRefcount[epochID] != 0 {
+			continue
+		}
+		candidates = append(candidates, liveCandidate{epochID: epochID, floor: t.versions.epochFloor[epochID]})
+	}
+	t.versions.liveScratch = candidates
+	if len(candidates) == 0 {
+		return stats, nil
+	}
+	nodes := t.versions.liveNodes[:0]
+	t.markLiveLocked(candidates, &nodes)
+	t.versions.liveNodes = nodes
+
+	moving, freed, epochs := 0, 0, 0
+	for i := range candidates {
+		c := &candidates[i]
+		capacity := t.memory.epochByID[c.epochID].Capacity()
+		c.move = c.live*compactMaxLiveFraction <= capacity
+		if c.move {
+			moving += c.live
+			freed += capacity
+			epochs++
+		}
+	}
+	if epochs < 2 || freed <= t.epochCapacity(moving+1) {
+		// epoch 하나를 같은 크기의 새 arena로 옮기면 얻는 것이 없다.
+		return stats, nil
+	}
+	var dst EpochStore
+	if moving > 0 {
+		var err error
+		if dst, err = t.acquireEpoch(moving + 1); err != nil {
+			return stats, err
+		}
+	}
+
+	slices.SortFunc(nodes, func(a, b liveNode) int { return cmp.Compare(a.candidate, b.candidate) })
+	var moveErr error
+	for lo := 0; lo < len(nodes); {
+		hi := lo + 1
+		for hi < len(nodes) && nodes[hi].candidate == nodes[lo].candidate {
+			hi++
+		}
+		c := &candidates[nodes[lo].candidate]
+		switch {
+		case !c.move:
+		case moveErr != nil || (stats.NodesMoved > 0 && !deadline.IsZero() && time.Now().After(deadline)):
+			// 남은 epoch은 다음 pass로 넘긴다.
+			c.move = false
+		default:
+			for _, n := range nodes[lo:hi] {
+				if moveErr = t.moveNodeLocked(dst, n.index); moveErr != nil {
+					// 이미 옮긴 노드의 사본은 무해하고, 이 epoch은 그대로 남는다.
+					c.move = false
+					break
+				}
+				stats.NodesMoved++
+			}
+		}
+		lo = hi
+	}
+
+	floor := uint64(math.MaxUint64)
+	released := t.versions.retired
+	seq := t.versions.publishSeq.Add(1)
+	orphans := t.versions.orphanEpochs[:0]
+	for _, epochID := range t.versions.orphanEpochs {
+		idx := slices.IndexFunc(candidates, func(c liveCandidate) bool { return c.epochID == epochID })
+		if idx < 0 || !candidates[idx].move {
+			orphans = append(orphans, epochID)
+			continue
+		}
+		c := &candidates[idx]
+		floor = min(floor, c.floor)
+		stats.Epochs++
+		stats.BytesReclaimed += int64(t.memory.epochByID[epochID].Capacity()) * NodeSize
+		// 옮기기 전의 locator를 읽은 reader는 버전과 상관없이 옛 arena를 볼 수 있다.
+		released = append(released, retiredEpoch{epochID: epochID, seq: seq, floor: 0})
+	}
+	if stats.NodesMoved > 0 {
+		orphans = append(orphans, dst.ID())
+		t.versions.epochRefcount[dst.ID()] = 0
+		t.versions.epochFloor[dst.ID()] = floor
+		stats.BytesReclaimed -= int64(dst.Capacity()) * NodeSize
+	} else if dst != nil {
+		t.discardEpoch(dst)
+	}
+	t.versions.orphanEpochs = orphans
+	t.versions.orphansChecked = len(orphans)
+	t.versions.retired = released
+	return stats, moveErr
+}
+
+// moveNodeLocked copies a node, and the record of a KV leaf, into dst and
+// repoints its locator entry. Readers that loaded the old entry keep reading
+// the old copy, which stays valid until the old arena is recycled.
+func (t *StateTree) moveNodeLocked(dst EpochStore, index uint32) error {
+	chunk, offset, ok := t.locate(index)
+	if !ok {
+		return ErrNodeIndexExhaust
+	}
+	node, src, ok := t.nodeByIndex(index)
+	if !ok {
+		return t.memory.store.Err()
+	}
+	// node16의 Children은 Blob 자리와 겹친다.
+	if isLeaf(node.Prefix) && node.Blob.valid() {
+		key, value, ok := src.Blob(node.Blob, &t.memory.blobScratch)
+		if ok {
+			ref, err := dst.AppendBlob(key, value)
+			if err != nil {
+				return err
+			}
+			node.Blob = ref
+		}
+	}
+	if dst.ID() > math.MaxUint32 {
+		return ErrEpochIDOverflow
+	}
+	local, err := appendNode(dst, node)
+	if err != nil {
+		return err
+	}
+	chunk.store(offset, nodeLocator{epochID: uint32(dst.ID()), localIndex: local})
+	t.recordIndicesLocked(dst.ID(), index, index+1)
+	return nil
+}
+
+// compactor runs Compact on a timer until the tree is closed.
+type compactor struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func startCompactor(t *StateTree, interval, budget time.Duration, report func(CompactStats)) *compactor {
+	c := &compactor{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			stats, _ := t.Compact(budget)
+			if report != nil && stats.Epochs > 0 {
+				report(stats)
+			}
+		}
+	}()
+	return c
+}
+
+// close stops the compactor and waits for a running pass. It must be called
+// without writerMu.
+func (c *compactor) close() {
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {
+		close(c.stop)
+		<-c.done
+	})
+}
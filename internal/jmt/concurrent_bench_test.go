@@ -2,7 +2,13 @@
 
 package jmt
 
-import "testing"
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/Pam-La/jmt_for_mac/internal/hash"
+)
 
 func BenchmarkJMTBatchCommit(b *testing.B) {
 	tree := NewStateTree(Config{
@@ -19,7 +25,7 @@ func BenchmarkJMTBatchCommit(b *testing.B) {
 		}
 	}
 
-	requiredPerBatch := uint64(estimateRequiredNodes(len(mutations)))
+	requiredPerBatch := uint64(estimateRequiredNodes(len(mutations), batchNodeEstimatePerMutation))
 	estimatedNodes := (uint64(b.N) + 1) * requiredPerBatch
 	maxNodes := uint64(maxNodeIndex - 1)
 	if estimatedNodes > maxNodes {
@@ -52,6 +58,87 @@ func BenchmarkJMTBatchCommit(b *testing.B) {
 	b.ReportMetric(float64(stats.ASMCalls), "asm_calls")
 }
 
+func BenchmarkJMTBatchCommitLanes(b *testing.B) {
+	for _, lanes := range []int{4, 8, 16} {
+		b.Run(fmt.Sprintf("x%d", lanes), func(b *testing.B) {
+			tree := NewStateTree(Config{
+				InitialArenaCapacity: 1 << 18,
+				RetainVersions:       4,
+				SIMDLanes:            lanes,
+			})
+			defer tree.Close()
+
+			mutations := make([]Mutation, 256)
+			for i := 0; i < len(mutations); i++ {
+				mutations[i] = Mutation{
+					Key:   fixedWord(byte(i)),
+					Value: fixedWord(byte(i + 1)),
+				}
+			}
+			if _, err := tree.ApplyBatch(mutations); err != nil {
+				b.Fatalf("warmup apply failed: %v", err)
+			}
+
+			b.ReportAllocs()
+			tree.Hasher().ResetStats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < len(mutations); j++ {
+					mutations[j].Value = fixedWord(byte((i + j) & 0xFF))
+				}
+				if _, err := tree.ApplyBatch(mutations); err != nil {
+					b.Fatalf("apply failed: %v", err)
+				}
+			}
+			b.StopTimer()
+			stats := tree.HashStats()
+			b.ReportMetric(stats.ParentSIMDRatio()*100, "simd_parent_pct")
+			b.ReportMetric(float64(stats.ASMCalls), "asm_calls")
+		})
+	}
+}
+
+// BenchmarkJMTBatchCommitParallel commits blocks of uniformly spread keys so
+// every commit partition gets work; serial is the single-core baseline.
+func BenchmarkJMTBatchCommitParallel(b *testing.B) {
+	const batchSize = 8192
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tree := NewStateTree(Config{
+				InitialArenaCapacity: 1 << 16,
+				RetainVersions:       2,
+				CommitWorkers:        workers,
+			})
+			defer tree.Close()
+
+			mutations := make([]Mutation, batchSize)
+			for i := range mutations {
+				mutations[i] = Mutation{
+					Key:   hash.Sum256(binary.BigEndian.AppendUint32(nil, uint32(i))),
+					Value: keyFromUint32(uint32(i)),
+				}
+			}
+			if err := tree.PreallocateLocatorChunks(uint32(estimateRequiredNodes(batchSize, batchNodeEstimatePerMutation) * (b.N + 2))); err != nil {
+				b.Fatalf("preallocate locator chunks failed: %v", err)
+			}
+			if _, err := tree.ApplyBatch(mutations); err != nil {
+				b.Fatalf("warmup apply failed: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range mutations {
+					mutations[j].Value = keyFromUint32(uint32(i + j))
+				}
+				if _, err := tree.ApplyBatch(mutations); err != nil {
+					b.Fatalf("apply failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkJMTProofConcurrent(b *testing.B) {
 	tree := NewStateTree(Config{
 		InitialArenaCapacity: 1 << 18,
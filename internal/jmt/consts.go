@@ -2,10 +2,15 @@
 
 package jmt
 
+import "time"
+
 // Tree topology and SIMD routing.
 const (
-	JMTTreeDepth  = 256
+	JMTTreeDepth = 256
+	// SIMDChunkSize is the default router lane width; Config.SIMDLanes may
+	// select 4, 8 or 16 (MaxSIMDLanes).
 	SIMDChunkSize = 4
+	MaxSIMDLanes  = 16
 )
 
 // Hardware and memory-layout assumptions.
@@ -27,12 +32,35 @@ const (
 	maxNodeIndex              = ^uint32(0)
 
 	minInitialArenaCapacity = 1024
-	defaultRetainVersions   = 8
-	retainRingMultiplier    = 8
+	// arena는 epoch마다 8MB chunk를 잡고 2MB까지의 slice를 그 안에 둔다. 새 epoch을 그만큼
+	// 잡아야 chunk를 놀리지 않고, 작은 배치가 epoch을 새로 열지 않고 이어서 쌓인다.
+	minEpochCapacity      = (2 << 20) / NodeSize
+	defaultRetainVersions = 8
+	retainRingMultiplier  = 8
 
 	warmPoolBootstrapCount = 3
 	warmPoolMaxSize        = 8
 
-	batchNodeEstimatePerMutation = 272
+	// 각자 slot을 갖는 read transaction 수다. 그 이상은 overflow slot 하나를 함께 쓰며, 그동안 reclaim이 보수적으로 미뤄진다.
+	maxReaderSlots = 512
+
+	// live 노드가 용량의 1/compactMaxLiveFraction 이하인 epoch만 압축한다.
+	compactMaxLiveFraction = 2
+	defaultCompactBudget   = 10 * time.Millisecond
+	// 공유 노드 때문에 남은 epoch이 이만큼 늘 때마다 커밋이 압축을 한 번 돌린다.
+	compactPinnedEpochs = 16
+
+	// leaf가 유일한 prefix에 놓이므로 mutation당 노드 수는 보통 트리 높이 정도다.
+	// 예약이 모자라면 배치를 되돌리고 최악의 경우(경로 전체 + leaf)로 다시 커밋한다.
+	batchNodeEstimatePerMutation = 64
+	batchNodeWorstPerMutation    = JMTTreeDepth + 1
 	batchNodeEstimateBase        = 2048
+
+	// 작은 배치는 worker를 깨우는 비용이 해싱보다 커서 writer 혼자 처리한다.
+	parallelCommitMinMutations = 1024
+	commitPartitionsPerWorker  = 4
+	maxCommitPartitions        = 256 // split depth <= 8, so the first key byte picks the partition
+
+	blobHeaderSize = 8
+	blobChunkSize  = 1 << 20
 )
@@ -0,0 +1,199 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"bytes"
+	"iter"
+)
+
+type ChangeKind uint8
+
+const (
+	ChangeInserted ChangeKind = iota + 1
+	ChangeUpdated
+	ChangeDeleted
+)
+
+// Change is one key that differs between two versions. OldLeafHash is zero
+// for inserts and NewLeafHash is zero for deletes.
+type Change struct {
+	Key         [32]byte
+	OldLeafHash [32]byte
+	NewLeafHash [32]byte
+	Kind        ChangeKind
+}
+
+// Diff streams the keys that changed from fromVersion to toVersion in key
+// order. Both roots are walked together and any subtree with the same index
+// or hash on both sides is skipped, so the cost follows the number of
+// changes rather than the size of the state. The versions are resolved when
+// iteration starts and stay readable until it ends; an unknown version is
+// reported as a single (Change{}, ErrUnknownVersion) pair. A node the store
+// cannot return ends the changes with the store's error, or ErrMissingNode.
+func (t *StateTree) Diff(fromVersion, toVersion uint64) iter.Seq2[Change, error] {
+	return func(yield func(Change, error) bool) {
+		var slot *readerSlot
+		t.writerMu.Lock()
+		from, okFrom := t.versions.versionRoots[fromVersion]
+		to, okTo := t.versions.versionRoots[toVersion]
+		if okFrom {
+			_, okFrom = t.memory.epochByID[from.epochID]
+		}
+		if okTo {
+			_, okTo = t.memory.epochByID[to.epochID]
+		}
+		if okFrom && okTo {
+			// ReadTxn과 같은 방식으로 순회하는 동안 reclaim을 막는다.
+			slot = t.enterReader()
+			slot.observe(max(fromVersion, toVersion))
+		}
+		t.writerMu.Unlock()
+		if !okFrom || !okTo {
+			yield(Change{}, ErrUnknownVersion)
+			return
+		}
+		defer slot.leave()
+
+		d := differ{tree: t, yield: yield}
+		d.diff(from.rootIndex, to.rootIndex)
+	}
+}
+
+type differ struct {
+	tree  *StateTree
+	yield func(Change, error) bool
+}
+
+func (d *differ) emit(key [32]byte, oldHash, newHash [32]byte, kind ChangeKind) bool {
+	return d.yield(Change{Key: key, OldLeafHash: oldHash, NewLeafHash: newHash, Kind: kind}, nil)
+}
+
+// diff compares two subtrees at the same position and reports whether the
+// consumer wants more changes.
+func (d *differ) diff(oldIndex, newIndex uint32) bool {
+	if oldIndex == newIndex {
+		return true
+	}
+	if oldIndex == 0 {
+		return d.leaves(newIndex, ChangeInserted)
+	}
+	if newIndex == 0 {
+		return d.leaves(oldIndex, ChangeDeleted)
+	}
+	oldNode, _, okOld := d.tree.nodeByIndex(oldIndex)
+	newNode, _, okNew := d.tree.nodeByIndex(newIndex)
+	if !okOld || !okNew {
+		return d.missing()
+	}
+	if oldNode.Hash == newNode.Hash {
+		return true
+	}
+
+	switch {
+	case isLeaf(oldNode.Prefix):
+		return d.leafAgainst(&oldNode, newIndex, true)
+	case isLeaf(newNode.Prefix):
+		return d.leafAgainst(&newNode, oldIndex, false)
+	}
+
+	var oldChildren, newChildren [16]uint32
+	width := childSlots(&oldNode, &oldChildren)
+	childSlots(&newNode, &newChildren)
+	for s := 0; s < width; s++ {
+		if !d.diff(oldChildren[s], newChildren[s]) {
+			return false
+		}
+	}
+	return true
+}
+
+// missing reports a node the store could not return and ends the diff.
+func (d *differ) missing() bool {
+	err := d.tree.memory.store.Err()
+	if err == nil {
+		err = ErrMissingNode
+	}
+	d.yield(Change{}, err)
+	return false
+}
+
+// leaves reports every leaf under index as inserted or deleted.
+func (d *differ) leaves(index uint32, kind ChangeKind) bool {
+	return d.walkLeaves(index, func(leaf *Node) bool {
+		if kind == ChangeInserted {
+			return d.emit(leaf.Key, [32]byte{}, leaf.Hash, kind)
+		}
+		return d.emit(leaf.Key, leaf.Hash, [32]byte{}, kind)
+	})
+}
+
+// leafAgainst compares a lone leaf on one side with a subtree on the other.
+// The leaf is merged into the subtree's leaves in key order; it matches at
+// most one of them.
+func (d *differ) leafAgainst(leaf *Node, other uint32, leafIsOld bool) bool {
+	leafKind, otherKind := ChangeDeleted, ChangeInserted
+	if !leafIsOld {
+		leafKind, otherKind = ChangeInserted, ChangeDeleted
+	}
+	emitLone := func(n *Node, kind ChangeKind) bool {
+		if kind == ChangeInserted {
+			return d.emit(n.Key, [32]byte{}, n.Hash, kind)
+		}
+		return d.emit(n.Key, n.Hash, [32]byte{}, kind)
+	}
+
+	placed := false
+	ok := d.walkLeaves(other, func(n *Node) bool {
+		if !placed {
+			cmp := bytes.Compare(leaf.Key[:], n.Key[:])
+			if cmp == 0 {
+				placed = true
+				if leaf.Hash == n.Hash {
+					return true
+				}
+				if leafIsOld {
+					return d.emit(n.Key, leaf.Hash, n.Hash, ChangeUpdated)
+				}
+				return d.emit(n.Key, n.Hash, leaf.Hash, ChangeUpdated)
+			}
+			if cmp < 0 {
+				placed = true
+				if !emitLone(leaf, leafKind) {
+					return false
+				}
+			}
+		}
+		return emitLone(n, otherKind)
+	})
+	if !ok {
+		return false
+	}
+	if !placed {
+		return emitLone(leaf, leafKind)
+	}
+	return true
+}
+
+// walkLeaves calls fn for every leaf under index in key order and stops
+// early when fn returns false or a node is missing.
+func (d *differ) walkLeaves(index uint32, fn func(*Node) bool) bool {
+	if index == 0 {
+		return true
+	}
+	node, _, ok := d.tree.nodeByIndex(index)
+	if !ok {
+		return d.missing()
+	}
+	if isLeaf(node.Prefix) {
+		return fn(&node)
+	}
+	var children [16]uint32
+	width := childSlots(&node, &children)
+	for s := 0; s < width; s++ {
+		if !d.walkLeaves(children[s], fn) {
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,7 @@ package jmt
 import (
 	"arena"
 	"errors"
+	"iter"
 	"sync/atomic"
 )
 
@@ -18,6 +19,7 @@ type EpochArena struct {
 	mem   *arena.Arena
 	nodes []Node
 	head  atomic.Uint32
+	blobs blobHeap
 	freed bool
 }
 
@@ -46,25 +48,28 @@ func (e *EpochArena) Head() uint32 {
 	return e.head.Load()
 }
 
-func (e *EpochArena) Remaining() int {
-	return len(e.nodes) - int(e.head.Load())
-}
-
 func (e *EpochArena) Truncate(newHead uint32) {
 	e.head.Store(newHead)
 }
 
-func (e *EpochArena) AllocNode(node Node) (uint32, error) {
+// Reserve claims n consecutive slots for a builder that fills them with
+// StoreAt, so several builders can write one epoch without sharing the head.
+func (e *EpochArena) Reserve(n uint32) (uint32, error) {
 	if e.freed {
 		return 0, ErrArenaFreed
 	}
-	idx := e.head.Load()
-	if int(idx) >= len(e.nodes) {
+	start := e.head.Load()
+	if uint64(start)+uint64(n) > uint64(len(e.nodes)) {
 		return 0, ErrArenaFull
 	}
+	e.head.Store(start + n)
+	return start, nil
+}
+
+//go:inline
+func (e *EpochArena) StoreAt(idx uint32, node Node) error {
 	e.nodes[idx] = node
-	e.head.Store(idx + 1)
-	return idx, nil
+	return nil
 }
 
 func (e *EpochArena) NodeAt(idx uint32) (Node, bool) {
@@ -74,10 +79,46 @@ func (e *EpochArena) NodeAt(idx uint32) (Node, bool) {
 	return e.nodes[idx], true
 }
 
+func (e *EpochArena) Nodes() iter.Seq2[uint32, Node] {
+	return func(yield func(uint32, Node) bool) {
+		head := e.head.Load()
+		for idx := uint32(1); idx < head; idx++ {
+			if !yield(idx, e.nodes[idx]) {
+				return
+			}
+		}
+	}
+}
+
+// AppendBlob stores a variable-length key/value record next to the epoch's
+// nodes so it is reclaimed together with the leaf that references it.
+func (e *EpochArena) AppendBlob(key []byte, value []byte) (BlobRef, error) {
+	if e.freed {
+		return BlobRef{}, ErrArenaFreed
+	}
+	return e.blobs.append(e.mem, key, value)
+}
+
+// Blob returns slices of the arena and leaves scratch alone.
+func (e *EpochArena) Blob(ref BlobRef, scratch *[]byte) ([]byte, []byte, bool) {
+	return e.blobs.record(ref)
+}
+
+// BlobMark packs the blob cursor as chunk<<32 | offset.
+func (e *EpochArena) BlobMark() BlobMark {
+	c := e.blobs.cursor
+	return BlobMark(uint64(c.chunk)<<32 | uint64(c.offset))
+}
+
+func (e *EpochArena) TruncateBlobs(mark BlobMark) {
+	e.blobs.cursor = blobMark{chunk: int(mark >> 32), offset: int(uint32(mark))}
+}
+
 func (e *EpochArena) Free() {
 	if e.freed {
 		return
 	}
+	e.blobs.release()
 	e.mem.Free()
 	e.freed = true
 	e.nodes = nil
@@ -100,5 +141,6 @@ func (e *EpochArena) ResetForReuse(newID uint64) error {
 	}
 	e.id = newID
 	e.head.Store(1)
+	e.blobs.reset()
 	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sync/atomic"
+	"unsafe"
 )
 
 func computeEpochRingSize(retain uint64) int {
@@ -31,9 +33,15 @@ func computeDefaultLocatorDirSize() int {
 	return int(n)
 }
 
+// epochCapacity is the capacity acquireEpoch gives an epoch asked to hold n
+// slots.
+func (t *StateTree) epochCapacity(n int) int {
+	return max(n, t.memory.initialArenaCapacity, minEpochCapacity)
+}
+
 // acquireEpoch returns a fresh epoch for a new version.
 // Caller must hold writerMu.
-func (t *StateTree) acquireEpoch(capacity int) (*EpochArena, error) {
+func (t *StateTree) acquireEpoch(capacity int) (EpochStore, error) {
 	if capacity < 2 {
 		capacity = 2
 	}
@@ -41,36 +49,18 @@ func (t *StateTree) acquireEpoch(capacity int) (*EpochArena, error) {
 		return nil, fmt.Errorf("invalid epoch capacity: %d", capacity)
 	}
 
-	ep := t.takeFromPoolOrAlloc(capacity)
+	ep, err := t.memory.store.NewEpoch(t.memory.nextEpochID, t.epochCapacity(capacity))
+	if err != nil {
+		return nil, err
+	}
+	t.memory.nextEpochID++
 	t.memory.epochs = append(t.memory.epochs, ep)
 	t.memory.epochByID[ep.ID()] = ep
-
-	slotIdx := ep.ID() % uint64(len(t.memory.epochRing))
-	t.memory.epochRing[slotIdx].arena.Store(ep)
-	t.memory.epochRing[slotIdx].epochID.Store(ep.ID())
-
+	t.memory.epochRing[ep.ID()%uint64(len(t.memory.epochRing))].publish(ep)
 	return ep, nil
 }
 
-func (t *StateTree) takeFromPoolOrAlloc(capacity int) *EpochArena {
-	if capacity < t.memory.initialArenaCapacity {
-		capacity = t.memory.initialArenaCapacity
-	}
-	if n := len(t.memory.warmPool); n > 0 {
-		ep := t.memory.warmPool[n-1]
-		if ep.Capacity() >= capacity {
-			t.memory.warmPool = t.memory.warmPool[:n-1]
-			_ = ep.ResetForReuse(t.memory.nextEpochID)
-			t.memory.nextEpochID++
-			return ep
-		}
-	}
-	ep := newEpochArena(t.memory.nextEpochID, capacity)
-	t.memory.nextEpochID++
-	return ep
-}
-
-func (t *StateTree) discardEpoch(epoch *EpochArena) {
+func (t *StateTree) discardEpoch(epoch EpochStore) {
 	if epoch == nil {
 		return
 	}
@@ -78,6 +68,8 @@ func (t *StateTree) discardEpoch(epoch *EpochArena) {
 		t.memory.activeEpoch = nil
 	}
 	delete(t.memory.epochByID, epoch.ID())
+	// 버려지는 epoch의 index는 undo가 이미 current run으로 되돌렸다.
+	t.memory.forgetIndicesLocked(epoch.ID())
 	for i := len(t.memory.epochs) - 1; i >= 0; i-- {
 		if t.memory.epochs[i] != epoch {
 			continue
@@ -85,32 +77,29 @@ func (t *StateTree) discardEpoch(epoch *EpochArena) {
 		t.memory.epochs = append(t.memory.epochs[:i], t.memory.epochs[i+1:]...)
 		break
 	}
-	slotIdx := epoch.ID() % uint64(len(t.memory.epochRing))
-	if t.memory.epochRing[slotIdx].epochID.Load() == epoch.ID() {
-		t.memory.epochRing[slotIdx].epochID.Store(0)
-		t.memory.epochRing[slotIdx].arena.Store(nil)
-	}
-	epoch.Free()
+	t.memory.epochRing[epoch.ID()%uint64(len(t.memory.epochRing))].unpublish(epoch.ID())
+	t.memory.store.ReleaseEpoch(epoch)
 }
 
 func (t *StateTree) reserveLocatorSpace(extra uint32) error {
 	if extra == 0 {
 		return nil
 	}
-	next := t.memory.nextLocator
-	if next+extra > maxNodeIndex || next+extra < next {
-		return ErrNodeIndexExhaust
-	}
 	store := t.memory.locatorStore.Load()
 	if store == nil {
 		return ErrNodeIndexExhaust
 	}
+	if err := t.takeLocatorRunLocked(extra); err != nil {
+		return err
+	}
+	next := t.memory.nextLocator
 	lastIndex := next + extra - 1
 	lastChunkIndex := int(lastIndex >> LocatorChunkShift)
 	if lastChunkIndex >= len(store.chunks) {
 		return ErrNodeIndexExhaust
 	}
-	for i := 0; i <= lastChunkIndex; i++ {
+	// 그 앞의 chunk는 이전 예약이 이미 잡아 두었다.
+	for i := int(next >> LocatorChunkShift); i <= lastChunkIndex; i++ {
 		if store.chunks[i].Load() == nil {
 			store.chunks[i].Store(&locatorChunk{})
 		}
@@ -126,17 +115,17 @@ func (t *StateTree) PreallocateLocatorChunks(nodes uint32) error {
 	return t.reserveLocatorSpace(nodes)
 }
 
-func (t *StateTree) allocNode(epoch *EpochArena, node Node) (uint32, error) {
+func (t *StateTree) allocNode(epoch EpochStore, node Node) (uint32, error) {
 	if epoch == nil {
 		return 0, errors.New("nil epoch")
 	}
-	localIndex, err := epoch.AllocNode(node)
+	localIndex, err := appendNode(epoch, node)
 	if err != nil {
 		return 0, err
 	}
 
 	id := t.memory.nextLocator
-	if id == 0 || id == maxNodeIndex {
+	if id == 0 || id >= t.memory.locatorEnd {
 		return 0, ErrNodeIndexExhaust
 	}
 
@@ -161,15 +150,131 @@ func (t *StateTree) allocNode(epoch *EpochArena, node Node) (uint32, error) {
 	if epochID > math.MaxUint32 {
 		return 0, ErrEpochIDOverflow
 	}
-	chunk[offset] = nodeLocator{
+	chunk.store(offset, nodeLocator{
 		epochID:    uint32(epochID),
 		localIndex: localIndex,
-	}
+	})
 	t.memory.nextLocator = id + 1
 	return id, nil
 }
 
-func (t *StateTree) nodeByIndex(index uint32) (Node, *EpochArena, bool) {
+// allocRegion은 한 builder가 독점하는 epoch slot 구간과 global index 구간이다.
+// builder는 공유 head를 건드리지 않고 구간 안에서만 노드를 쓰므로 여러 worker가 동시에 채울 수 있다.
+type allocRegion struct {
+	epoch     EpochStore
+	epochID   uint32
+	nextLocal uint32
+	endLocal  uint32
+	nextID    uint32
+	endID     uint32
+}
+
+// carveRegion reserves n arena slots and n global indices for one builder.
+// The indices come from the current run, and their locator chunks must
+// already be reserved with reserveLocatorSpace.
+// Caller must hold writerMu.
+func (t *StateTree) carveRegion(epoch EpochStore, n uint32) (allocRegion, error) {
+	if epoch == nil {
+		return allocRegion{}, errors.New("nil epoch")
+	}
+	if epoch.ID() > math.MaxUint32 {
+		return allocRegion{}, ErrEpochIDOverflow
+	}
+	id := t.memory.nextLocator
+	if id == 0 || id+n > t.memory.locatorEnd || id+n < id {
+		return allocRegion{}, ErrNodeIndexExhaust
+	}
+	start, err := epoch.Reserve(n)
+	if err != nil {
+		return allocRegion{}, err
+	}
+	t.memory.nextLocator = id + n
+	return allocRegion{
+		epoch:     epoch,
+		epochID:   uint32(epoch.ID()),
+		nextLocal: start,
+		endLocal:  start + n,
+		nextID:    id,
+		endID:     id + n,
+	}, nil
+}
+
+// trimRegion returns the unused tail of r. Arena slots come back only if r
+// is still the most recently carved region; earlier regions keep their
+// slot tails as unreferenced gaps, and their index tails are freed.
+func (t *StateTree) trimRegion(r *allocRegion) {
+	if r.epoch.Head() == r.endLocal {
+		r.epoch.Truncate(r.nextLocal)
+	}
+	if t.memory.nextLocator == r.endID {
+		t.memory.nextLocator = r.nextID
+	} else {
+		t.memory.freeIndexRun(r.nextID, r.endID)
+	}
+}
+
+func (t *StateTree) allocInRegion(r *allocRegion, node Node) (uint32, error) {
+	if r.nextLocal >= r.endLocal || r.nextID >= r.endID {
+		return 0, ErrArenaFull
+	}
+	store := t.memory.locatorStore.Load()
+	if store == nil {
+		return 0, ErrNodeIndexExhaust
+	}
+	id := r.nextID
+	chunkIndex := int(id >> LocatorChunkShift)
+	if chunkIndex >= len(store.chunks) {
+		return 0, ErrNodeIndexExhaust
+	}
+	chunk := store.chunks[chunkIndex].Load()
+	if chunk == nil {
+		return 0, ErrNodeIndexExhaust
+	}
+
+	if err := r.epoch.StoreAt(r.nextLocal, node); err != nil {
+		return 0, err
+	}
+	chunk.store(id&LocatorChunkMask, nodeLocator{
+		epochID:    r.epochID,
+		localIndex: r.nextLocal,
+	})
+	r.nextLocal++
+	r.nextID++
+	return id, nil
+}
+
+// 압축이 reader와 동시에 locator를 옮기므로 entry는 64-bit 단위로 원자적으로 읽고 쓴다.
+//
+//go:inline
+func (c *locatorChunk) load(offset uint32) nodeLocator {
+	v := (*atomic.Uint64)(unsafe.Pointer(&c[offset])).Load()
+	return *(*nodeLocator)(unsafe.Pointer(&v))
+}
+
+//go:inline
+func (c *locatorChunk) store(offset uint32, loc nodeLocator) {
+	(*atomic.Uint64)(unsafe.Pointer(&c[offset])).Store(*(*uint64)(unsafe.Pointer(&loc)))
+}
+
+// locate returns the locator entry of a global index, or false when the
+// index has never been allocated.
+func (t *StateTree) locate(index uint32) (*locatorChunk, uint32, bool) {
+	store := t.memory.locatorStore.Load()
+	if store == nil {
+		return nil, 0, false
+	}
+	chunkIndex := int(index >> LocatorChunkShift)
+	if chunkIndex >= len(store.chunks) {
+		return nil, 0, false
+	}
+	chunk := store.chunks[chunkIndex].Load()
+	if chunk == nil {
+		return nil, 0, false
+	}
+	return chunk, index & LocatorChunkMask, true
+}
+
+func (t *StateTree) nodeByIndex(index uint32) (Node, EpochStore, bool) {
 	if index == 0 {
 		return Node{}, nil, false
 	}
@@ -185,7 +290,7 @@ func (t *StateTree) nodeByIndex(index uint32) (Node, *EpochArena, bool) {
 	if chunk == nil {
 		return Node{}, nil, false
 	}
-	loc := chunk[index&LocatorChunkMask]
+	loc := chunk.load(index & LocatorChunkMask)
 	if loc.localIndex == 0 {
 		return Node{}, nil, false
 	}
@@ -194,19 +299,8 @@ func (t *StateTree) nodeByIndex(index uint32) (Node, *EpochArena, bool) {
 	if len(ring) == 0 {
 		return Node{}, nil, false
 	}
-	slotIdx := uint64(loc.epochID) % uint64(len(ring))
-	slotEpochID := ring[slotIdx].epochID.Load()
-	if slotEpochID != uint64(loc.epochID) {
-		return Node{}, nil, false
-	}
-	epoch := ring[slotIdx].arena.Load()
-	if epoch == nil || epoch.IsFreed() {
-		return Node{}, nil, false
-	}
-	if epoch.ID() != slotEpochID {
-		return Node{}, nil, false
-	}
-	if ring[slotIdx].epochID.Load() != slotEpochID {
+	epoch := ring[uint64(loc.epochID)%uint64(len(ring))].lookup(uint64(loc.epochID))
+	if epoch == nil {
 		return Node{}, nil, false
 	}
 
@@ -0,0 +1,322 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+)
+
+// fileStore keeps every epoch in one file, dir/epochs. An epoch owns an
+// extent holding slot i at i*NodeSize and blob chunks holding its records
+// back to back, framed like the arena's. Extents of released epochs are
+// reused first, so the file stays about as large as the live epochs and
+// the store holds one descriptor however many epochs are live. Every access
+// is a positioned read or write, so nodes cost no memory but each read is a
+// system call. The file is scratch space, removed on Close; durability
+// comes from the write-ahead log and checkpoints as with the arena store.
+// A failed read is kept in err and fails every later commit and proof.
+type fileStore struct {
+	file *os.File
+	err  atomic.Pointer[error]
+
+	// Only the writer allocates and frees extents and appends blobs.
+	end     int64
+	free    []extent
+	scratch []byte
+	// idle holds released epochs for reuse, with their blob chunks, like the
+	// arena store's warm pool.
+	idle []*fileEpoch
+}
+
+// extent is the byte range [off, off+size) of the store's file.
+type extent struct {
+	off  int64
+	size int64
+}
+
+// NewFileNodeStore returns a NodeStore that keeps epochs in a file under
+// dir, creating dir if needed.
+func NewFileNodeStore(dir string) (NodeStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "epochs"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{file: file, idle: make([]*fileEpoch, 0, warmPoolMaxSize)}, nil
+}
+
+func (s *fileStore) NewEpoch(id uint64, capacity int) (EpochStore, error) {
+	capacity = max(capacity, 2)
+	var e *fileEpoch
+	if n := len(s.idle); n > 0 {
+		// 풀에서 나온 epoch은 이전 blob chunk를 처음부터 다시 채운다.
+		e = s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		e.id, e.capacity, e.cursor = id, capacity, blobMark{}
+	} else {
+		e = &fileEpoch{store: s, id: id, capacity: capacity}
+	}
+	e.nodes = s.alloc(int64(capacity) * NodeSize)
+	e.head.Store(1) // 0은 nil 노드
+	return e, nil
+}
+
+func (s *fileStore) ReleaseEpoch(epoch EpochStore) {
+	e := epoch.(*fileEpoch)
+	s.release(extent{off: e.nodes, size: int64(e.capacity) * NodeSize})
+	if len(s.idle) < warmPoolMaxSize {
+		s.idle = append(s.idle, e)
+		return
+	}
+	for _, chunk := range e.chunks {
+		s.release(chunk)
+	}
+	e.chunks = nil
+	e.dir.Store(nil)
+}
+
+func (s *fileStore) Close() error {
+	err := s.file.Close()
+	if rmErr := os.Remove(s.file.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (s *fileStore) Err() error {
+	if err := s.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// fail records the first read error.
+func (s *fileStore) fail(err error) {
+	s.err.CompareAndSwap(nil, &err)
+}
+
+// alloc returns the offset of size free bytes, taking the first released
+// extent that fits before growing the file.
+func (s *fileStore) alloc(size int64) int64 {
+	for i, e := range s.free {
+		if e.size < size {
+			continue
+		}
+		if e.size == size {
+			s.free = slices.Delete(s.free, i, i+1)
+		} else {
+			s.free[i] = extent{off: e.off + size, size: e.size - size}
+		}
+		return e.off
+	}
+	off := s.end
+	s.end += size
+	return off
+}
+
+// release frees an extent, merging it with its neighbours, and shrinks the
+// file when the extent was its tail.
+func (s *fileStore) release(e extent) {
+	if e.size == 0 {
+		return
+	}
+	runs := s.free
+	i, _ := slices.BinarySearchFunc(runs, e.off, func(r extent, off int64) int { return cmp.Compare(r.off, off) })
+	if i < len(runs) && e.off+e.size == runs[i].off {
+		e.size += runs[i].size
+		runs = slices.Delete(runs, i, i+1)
+	}
+	if i > 0 && runs[i-1].off+runs[i-1].size == e.off {
+		i--
+		e = extent{off: runs[i].off, size: runs[i].size + e.size}
+		runs = slices.Delete(runs, i, i+1)
+	}
+	if e.off+e.size == s.end {
+		s.end = e.off
+		// 실패해도 꼬리가 남을 뿐이고 다음 alloc이 그 자리를 덮어쓴다.
+		_ = s.file.Truncate(s.end)
+	} else {
+		runs = slices.Insert(runs, i, e)
+	}
+	s.free = runs
+}
+
+type fileEpoch struct {
+	store    *fileStore
+	id       uint64
+	capacity int
+	// nodes is the file offset of slot 0.
+	nodes int64
+	head  atomic.Uint32
+	// chunks are the blob extents; dir publishes them to readers like the
+	// arena blob heap's chunk directory.
+	dir    atomic.Pointer[[]extent]
+	chunks []extent
+	cursor blobMark
+}
+
+func (e *fileEpoch) ID() uint64 {
+	return e.id
+}
+
+func (e *fileEpoch) Capacity() int {
+	return e.capacity
+}
+
+func (e *fileEpoch) Head() uint32 {
+	return e.head.Load()
+}
+
+func (e *fileEpoch) Truncate(head uint32) {
+	e.head.Store(head)
+}
+
+func (e *fileEpoch) Reserve(n uint32) (uint32, error) {
+	start := e.head.Load()
+	if uint64(start)+uint64(n) > uint64(e.capacity) {
+		return 0, ErrArenaFull
+	}
+	e.head.Store(start + n)
+	return start, nil
+}
+
+func (e *fileEpoch) StoreAt(slot uint32, node Node) error {
+	_, err := e.store.file.WriteAt(nodeBytes(&node), e.nodes+int64(slot)*NodeSize)
+	return err
+}
+
+func (e *fileEpoch) NodeAt(slot uint32) (Node, bool) {
+	var node Node
+	if slot == 0 || slot >= e.head.Load() {
+		return node, false
+	}
+	if _, err := e.store.file.ReadAt(nodeBytes(&node), e.nodes+int64(slot)*NodeSize); err != nil {
+		e.store.fail(fmt.Errorf("epoch %d: read node %d: %w", e.id, slot, err))
+		return Node{}, false
+	}
+	return node, true
+}
+
+func (e *fileEpoch) Nodes() iter.Seq2[uint32, Node] {
+	return func(yield func(uint32, Node) bool) {
+		head := e.head.Load()
+		for slot := uint32(1); slot < head; slot++ {
+			node, ok := e.NodeAt(slot)
+			if !ok || !yield(slot, node) {
+				return
+			}
+		}
+	}
+}
+
+// AppendBlob writes the record at the blob cursor, opening a chunk of
+// blobChunkSize, or the record's size if larger, when the current one is
+// full. The ref holds the chunk and the offset in it.
+func (e *fileEpoch) AppendBlob(key []byte, value []byte) (BlobRef, error) {
+	need := blobHeaderSize + len(key) + len(value)
+	if uint64(need) > math.MaxUint32 {
+		return BlobRef{}, ErrBlobTooLarge
+	}
+	s := e.store
+	c := &e.cursor
+	for c.chunk < len(e.chunks) && int64(c.offset+need) > e.chunks[c.chunk].size {
+		c.chunk++
+		c.offset = 0
+	}
+	if c.chunk == len(e.chunks) {
+		size := int64(max(need, blobChunkSize))
+		chunks := append(e.chunks[:len(e.chunks):len(e.chunks)], extent{off: s.alloc(size), size: size})
+		e.chunks = chunks
+		e.dir.Store(&chunks)
+	}
+
+	if cap(s.scratch) < need {
+		s.scratch = make([]byte, need)
+	}
+	buf := s.scratch[:need]
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(value)))
+	copy(buf[blobHeaderSize:], key)
+	copy(buf[blobHeaderSize+len(key):], value)
+	if _, err := s.file.WriteAt(buf, e.chunks[c.chunk].off+int64(c.offset)); err != nil {
+		return BlobRef{}, err
+	}
+	ref := BlobRef{Chunk: uint32(c.chunk) + 1, Offset: uint32(c.offset)}
+	c.offset += need
+	return ref, nil
+}
+
+// Blob reads the record into *scratch, growing it if needed. A record that
+// fits in scratch costs one read.
+func (e *fileEpoch) Blob(ref BlobRef, scratch *[]byte) ([]byte, []byte, bool) {
+	dir := e.dir.Load()
+	if !ref.valid() || dir == nil || int(ref.Chunk) > len(*dir) {
+		return nil, nil, false
+	}
+	chunk := (*dir)[ref.Chunk-1]
+	avail := chunk.size - int64(ref.Offset)
+	if avail < blobHeaderSize {
+		return nil, nil, false
+	}
+	off := chunk.off + int64(ref.Offset)
+	buf := (*scratch)[:cap(*scratch)]
+	if len(buf) < blobHeaderSize {
+		buf = make([]byte, blobHeaderSize+64)
+	}
+	// chunk의 기록되지 않은 꼬리는 파일 끝 너머일 수 있으므로 header만 읽히면 된다.
+	n, err := e.readAt(buf[:min(int64(len(buf)), avail)], off, blobHeaderSize)
+	if err != nil {
+		return nil, nil, false
+	}
+	keyLen := int(binary.LittleEndian.Uint32(buf[0:]))
+	valueLen := int(binary.LittleEndian.Uint32(buf[4:]))
+	total := blobHeaderSize + keyLen + valueLen
+	if int64(total) > avail {
+		return nil, nil, false
+	}
+	if total > n {
+		if total > len(buf) {
+			grown := make([]byte, total)
+			copy(grown, buf[:n])
+			buf = grown
+		}
+		if _, err := e.readAt(buf[n:total], off+int64(n), total-n); err != nil {
+			return nil, nil, false
+		}
+	}
+	*scratch = buf[:0]
+	return buf[blobHeaderSize : blobHeaderSize+keyLen], buf[blobHeaderSize+keyLen : total], true
+}
+
+// readAt reads into p at off and succeeds once at least need bytes are in.
+func (e *fileEpoch) readAt(p []byte, off int64, need int) (int, error) {
+	n, err := e.store.file.ReadAt(p, off)
+	if n >= need {
+		return n, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	e.store.fail(fmt.Errorf("epoch %d: read blob at %d: %w", e.id, off, err))
+	return n, err
+}
+
+// BlobMark packs the blob cursor as chunk<<32 | offset.
+func (e *fileEpoch) BlobMark() BlobMark {
+	return BlobMark(uint64(e.cursor.chunk)<<32 | uint64(e.cursor.offset))
+}
+
+func (e *fileEpoch) TruncateBlobs(mark BlobMark) {
+	e.cursor = blobMark{chunk: int(mark >> 32), offset: int(uint32(mark))}
+}
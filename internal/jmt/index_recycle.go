@@ -0,0 +1,217 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"cmp"
+	"slices"
+)
+
+// indexRun is the global index range [start, end).
+type indexRun struct {
+	start uint32
+	end   uint32
+}
+
+// Global node indices are recycled in runs. Every batch takes its indices
+// from one run: the rest of the current one, a recycled run from
+// freeIndices, or the never-used tail. The runs a batch was handed are
+// recorded on its epoch, and when the epoch is recycled every index whose
+// locator entry still names it goes back to freeIndices.
+//
+// The locator entry's epoch ID is the generation tag. Epoch IDs are never
+// reused, so an index that was rewound, moved by Compact or handed to
+// another epoch no longer names the recycled epoch and is not freed twice.
+// Indices in freeIndices and in the current run always have a zero entry.
+
+// locatorHighLocked returns one past the highest global index ever handed
+// out.
+func (t *StateTree) locatorHighLocked() uint32 {
+	if t.memory.locatorEnd == maxNodeIndex {
+		return t.memory.nextLocator
+	}
+	return t.memory.locatorTail
+}
+
+// takeLocatorRunLocked makes sure the current run has room for n indices.
+// Recycled runs are preferred to the tail: the first one that fits is taken
+// when the current run is the tail or too short. It changes nothing when it
+// fails.
+func (t *StateTree) takeLocatorRunLocked(n uint32) error {
+	m := &t.memory
+	onTail := m.locatorEnd == maxNodeIndex
+	if !onTail && m.locatorEnd-m.nextLocator >= n {
+		return nil
+	}
+	i := slices.IndexFunc(m.freeIndices, func(r indexRun) bool { return r.end-r.start >= n })
+	if i < 0 {
+		tail := t.locatorHighLocked()
+		if tail+n > maxNodeIndex || tail+n < tail {
+			return ErrNodeIndexExhaust
+		}
+		if !onTail {
+			t.releaseLocatorRunLocked()
+			m.nextLocator, m.locatorEnd = tail, maxNodeIndex
+		}
+		return nil
+	}
+	run := m.freeIndices[i]
+	m.freeIndices = slices.Delete(m.freeIndices, i, i+1)
+	t.releaseLocatorRunLocked()
+	m.nextLocator, m.locatorEnd = run.start, run.end
+	return nil
+}
+
+// releaseLocatorRunLocked gives back the unused rest of the current run.
+func (t *StateTree) releaseLocatorRunLocked() {
+	m := &t.memory
+	if m.locatorEnd == maxNodeIndex {
+		m.locatorTail = m.nextLocator
+		return
+	}
+	m.freeIndexRun(m.nextLocator, m.locatorEnd)
+}
+
+// rewindLocatorLocked hands the indices from to nextLocator, all written in
+// the current run after from, back to it.
+func (t *StateTree) rewindLocatorLocked(from uint32) {
+	m := &t.memory
+	for index := from; index < m.nextLocator; index++ {
+		if chunk, offset, ok := t.locate(index); ok {
+			chunk.store(offset, nodeLocator{})
+		}
+	}
+	// 이 구간 안에서 trimRegion이 free로 돌려준 꼬리는 다시 current run에 속한다.
+	m.clipFreeIndices(from, m.nextLocator)
+	m.nextLocator = from
+}
+
+// epochRuns lists the index runs of one epoch. Entries and their run
+// slices are reused once the epoch is recycled, so recording a commit's
+// indices allocates nothing in steady state. A zero epochID marks a free
+// entry.
+type epochRuns struct {
+	epochID uint64
+	runs    []indexRun
+}
+
+// epochRunsLocked returns epochID's entry, or nil. The active epoch is
+// almost always the last entry looked up, so that one is checked first.
+func (m *MemoryManager) epochRunsLocked(epochID uint64) *epochRuns {
+	if i := m.lastIndices; i < len(m.epochIndices) && m.epochIndices[i].epochID == epochID {
+		return &m.epochIndices[i]
+	}
+	for i := range m.epochIndices {
+		if m.epochIndices[i].epochID == epochID {
+			m.lastIndices = i
+			return &m.epochIndices[i]
+		}
+	}
+	return nil
+}
+
+// recordIndicesLocked records that epochID's nodes use indices [start, end).
+func (t *StateTree) recordIndicesLocked(epochID uint64, start, end uint32) {
+	if start >= end {
+		return
+	}
+	m := &t.memory
+	e := m.epochRunsLocked(epochID)
+	if e == nil {
+		i := slices.IndexFunc(m.epochIndices, func(e epochRuns) bool { return e.epochID == 0 })
+		if i < 0 {
+			i = len(m.epochIndices)
+			m.epochIndices = append(m.epochIndices, epochRuns{})
+		}
+		e = &m.epochIndices[i]
+		e.epochID = epochID
+		m.lastIndices = i
+	}
+	if n := len(e.runs); n > 0 && e.runs[n-1].end == start {
+		e.runs[n-1].end = end
+		return
+	}
+	e.runs = append(e.runs, indexRun{start: start, end: end})
+}
+
+// forgetIndicesLocked drops epochID's entry for reuse without freeing its
+// indices.
+func (m *MemoryManager) forgetIndicesLocked(epochID uint64) {
+	if e := m.epochRunsLocked(epochID); e != nil {
+		e.epochID = 0
+		e.runs = e.runs[:0]
+	}
+}
+
+// freeEpochIndicesLocked frees the indices recorded on a recycled epoch
+// whose locator entries still name it.
+func (t *StateTree) freeEpochIndicesLocked(epochID uint64) {
+	m := &t.memory
+	e := m.epochRunsLocked(epochID)
+	if e == nil {
+		return
+	}
+	for _, run := range e.runs {
+		start := run.start
+		for index := run.start; index < run.end; index++ {
+			chunk, offset, ok := t.locate(index)
+			if ok && uint64(chunk.load(offset).epochID) == epochID {
+				chunk.store(offset, nodeLocator{})
+				continue
+			}
+			m.freeIndexRun(start, index)
+			start = index + 1
+		}
+		m.freeIndexRun(start, run.end)
+	}
+	e.epochID = 0
+	e.runs = e.runs[:0]
+}
+
+// freeIndexRun adds [start, end) to freeIndices, merging it with its
+// neighbours.
+func (m *MemoryManager) freeIndexRun(start, end uint32) {
+	if start >= end {
+		return
+	}
+	runs := m.freeIndices
+	i, _ := slices.BinarySearchFunc(runs, start, func(r indexRun, s uint32) int { return cmp.Compare(r.start, s) })
+	switch {
+	case i > 0 && runs[i-1].end == start:
+		runs[i-1].end = end
+		if i < len(runs) && runs[i].start == end {
+			runs[i-1].end = runs[i].end
+			runs = slices.Delete(runs, i, i+1)
+		}
+	case i < len(runs) && runs[i].start == end:
+		runs[i].start = start
+	default:
+		runs = slices.Insert(runs, i, indexRun{start: start, end: end})
+	}
+	m.freeIndices = runs
+}
+
+// clipFreeIndices removes [start, end) from freeIndices.
+func (m *MemoryManager) clipFreeIndices(start, end uint32) {
+	runs := m.freeIndices
+	for i := 0; i < len(runs); {
+		r := runs[i]
+		switch {
+		case r.end <= start || r.start >= end:
+			i++
+		case r.start < start && r.end > end:
+			runs[i].end = start
+			runs = slices.Insert(runs, i+1, indexRun{start: end, end: r.end})
+			i += 2
+		case r.start < start:
+			runs[i].end = start
+			i++
+		case r.end > end:
+			runs[i].start = end
+			i++
+		default:
+			runs = slices.Delete(runs, i, i+1)
+		}
+	}
+	m.freeIndices = runs
+}
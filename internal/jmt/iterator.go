@@ -0,0 +1,247 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"bytes"
+	"iter"
+)
+
+// iterFrame은 iterator 경로 위의 internal 노드와 현재 내려간 자식 slot이다.
+type iterFrame struct {
+	index uint32
+	slot  uint8
+}
+
+// Iterator walks the leaves of a snapshot in key order. It keeps the path
+// from the root to the current leaf, so Next and Prev only re-read the
+// nodes they climb through and never allocate. An Iterator is valid while
+// the ReadTxn that created it is held.
+type Iterator struct {
+	tree  *StateTree
+	root  uint32
+	stack [JMTTreeDepth]iterFrame
+	depth int
+	leaf  Node
+	epoch EpochStore
+	valid bool
+	// blob is Record's scratch for stores that copy records out.
+	blob []byte
+}
+
+// NewIterator returns an unpositioned iterator over the transaction's
+// snapshot; call First, Last or Seek before reading it.
+func (r ReadTxn) NewIterator() *Iterator {
+	it := &Iterator{}
+	it.reset(r)
+	return it
+}
+
+func (it *Iterator) reset(r ReadTxn) {
+	it.tree = r.tree
+	it.root = 0
+	if r.snapshot != nil {
+		it.root = r.snapshot.RootIndex
+	}
+	it.depth = 0
+	it.valid = false
+}
+
+// Range yields the key/value pairs with start <= key < end in key order.
+// A nil bound leaves that side open.
+func (r ReadTxn) Range(start, end *[32]byte) iter.Seq2[[32]byte, [32]byte] {
+	return func(yield func([32]byte, [32]byte) bool) {
+		if r.snapshot == nil {
+			return
+		}
+		var it Iterator
+		it.reset(r)
+		var ok bool
+		if start == nil {
+			ok = it.First()
+		} else {
+			ok = it.Seek(*start)
+		}
+		for ; ok; ok = it.Next() {
+			if end != nil && bytes.Compare(it.leaf.Key[:], end[:]) >= 0 {
+				return
+			}
+			if !yield(it.leaf.Key, it.leaf.Value) {
+				return
+			}
+		}
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() [32]byte {
+	return it.leaf.Key
+}
+
+func (it *Iterator) Value() [32]byte {
+	return it.leaf.Value
+}
+
+// Record returns the original key and value of a leaf written through
+// ApplyKVBatch. The slices alias arena memory owned by the snapshot or, with
+// a file store, the iterator's buffer, which the next Record call reuses.
+func (it *Iterator) Record() ([]byte, []byte, bool) {
+	if !it.valid || !it.leaf.Blob.valid() {
+		return nil, nil, false
+	}
+	return it.epoch.Blob(it.leaf.Blob, &it.blob)
+}
+
+// First moves to the smallest key.
+func (it *Iterator) First() bool {
+	it.depth = 0
+	return it.descend(it.root, true)
+}
+
+// Last moves to the largest key.
+func (it *Iterator) Last() bool {
+	it.depth = 0
+	return it.descend(it.root, false)
+}
+
+// Seek moves to the smallest key >= key.
+func (it *Iterator) Seek(key [32]byte) bool {
+	it.depth = 0
+	it.valid = false
+	current := it.root
+	for current != 0 {
+		node, epoch, ok := it.tree.nodeByIndex(current)
+		if !ok {
+			return false
+		}
+		if isLeaf(node.Prefix) {
+			it.setLeaf(node, epoch)
+			if bytes.Compare(node.Key[:], key[:]) >= 0 {
+				return true
+			}
+			return it.advance(true)
+		}
+
+		var children [16]uint32
+		width := childSlots(&node, &children)
+		slot := keySlot(&node, key)
+		if children[slot] != 0 {
+			it.push(current, slot)
+			current = children[slot]
+			continue
+		}
+		// key의 서브트리가 비어 있으면 오른쪽 slot의 key는 모두 key보다 크다.
+		for s := slot + 1; s < width; s++ {
+			if children[s] != 0 {
+				it.push(current, s)
+				return it.descend(children[s], true)
+			}
+		}
+		return it.advance(true)
+	}
+	return false
+}
+
+// Next moves to the following key.
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.advance(true)
+}
+
+// Prev moves to the preceding key.
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.advance(false)
+}
+
+//go:inline
+func keySlot(node *Node, key [32]byte) int {
+	depth := decodeDepth(node.Prefix)
+	if isRadix16(node.Prefix) {
+		return nibbleAt(key, int(depth/4))
+	}
+	return int(bitAt(key, depth))
+}
+
+//go:inline
+func (it *Iterator) push(index uint32, slot int) {
+	it.stack[it.depth] = iterFrame{index: index, slot: uint8(slot)}
+	it.depth++
+}
+
+func (it *Iterator) setLeaf(node Node, epoch EpochStore) {
+	it.leaf = node
+	it.epoch = epoch
+	it.valid = true
+}
+
+// advance climbs to the nearest ancestor with a non-empty slot in the given
+// direction and descends to the extreme leaf of that slot.
+func (it *Iterator) advance(forward bool) bool {
+	for it.depth > 0 {
+		frame := &it.stack[it.depth-1]
+		node, _, ok := it.tree.nodeByIndex(frame.index)
+		if !ok {
+			break
+		}
+		var children [16]uint32
+		width := childSlots(&node, &children)
+		if forward {
+			for s := int(frame.slot) + 1; s < width; s++ {
+				if children[s] != 0 {
+					frame.slot = uint8(s)
+					return it.descend(children[s], true)
+				}
+			}
+		} else {
+			for s := int(frame.slot) - 1; s >= 0; s-- {
+				if children[s] != 0 {
+					frame.slot = uint8(s)
+					return it.descend(children[s], false)
+				}
+			}
+		}
+		it.depth--
+	}
+	it.valid = false
+	return false
+}
+
+// descend follows the first (forward) or last non-empty child down to a leaf.
+func (it *Iterator) descend(current uint32, forward bool) bool {
+	for current != 0 {
+		node, epoch, ok := it.tree.nodeByIndex(current)
+		if !ok {
+			break
+		}
+		if isLeaf(node.Prefix) {
+			it.setLeaf(node, epoch)
+			return true
+		}
+
+		var children [16]uint32
+		width := childSlots(&node, &children)
+		next := uint32(0)
+		for i := 0; i < width; i++ {
+			s := i
+			if !forward {
+				s = width - 1 - i
+			}
+			if children[s] != 0 {
+				it.push(current, s)
+				next = children[s]
+				break
+			}
+		}
+		current = next
+	}
+	it.valid = false
+	return false
+}
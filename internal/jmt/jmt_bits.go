@@ -2,12 +2,16 @@
 
 package jmt
 
-import "bytes"
+import (
+	"bytes"
+	"math/bits"
+)
 
 const (
-	leafBitMask uint64 = 1 << 47
-	depthShift  uint64 = 48
-	depthMask   uint64 = 0xFFFF << depthShift
+	leafBitMask    uint64 = 1 << 47
+	radix16BitMask uint64 = 1 << 46
+	depthShift     uint64 = 48
+	depthMask      uint64 = 0xFFFF << depthShift
 )
 
 //go:inline
@@ -29,6 +33,11 @@ func isLeaf(prefix uint64) bool {
 	return (prefix & leafBitMask) != 0
 }
 
+//go:inline
+func isRadix16(prefix uint64) bool {
+	return (prefix & radix16BitMask) != 0
+}
+
 //go:inline
 func samePrefix(a [32]byte, b [32]byte, depth uint16) bool {
 	fullBytes := int(depth / 8)
@@ -74,3 +83,13 @@ func prefixPath(key [32]byte, depth uint16) [32]byte {
 	}
 	return out
 }
+
+// commonPrefixBits returns the number of leading bits a and b share.
+func commonPrefixBits(a [32]byte, b [32]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return 8*i + bits.LeadingZeros8(x)
+		}
+	}
+	return JMTTreeDepth
+}
@@ -9,6 +9,10 @@ import (
 
 var _ [NodeSize - int(unsafe.Sizeof(Node{}))]byte
 var _ [int(unsafe.Sizeof(Node{})) - NodeSize]byte
+var _ [NodeSize - int(unsafe.Sizeof(node16{}))]byte
+var _ [int(unsafe.Sizeof(node16{})) - NodeSize]byte
+var _ [8 - unsafe.Sizeof(nodeLocator{})]byte
+var _ [unsafe.Sizeof(nodeLocator{}) - 8]byte
 
 func hasForbiddenPointerKinds(t reflect.Type) bool {
 	switch t.Kind() {
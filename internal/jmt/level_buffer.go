@@ -6,6 +6,17 @@ type levelEntry struct {
 	key     [32]byte
 	index   uint32
 	witness uint32
+	// leaf는 서브트리가 leaf 하나뿐이라 sibling이 비면 위 level로 그대로 올라가는 entry다.
+	leaf bool
+}
+
+// leafSeed is one bottom entry of a batch: a mutation (leaf == 0, witness is
+// its index) or an existing leaf pushed down because a mutation landed in
+// its slot (leaf is its index, witness is a mutation on the same path).
+type leafSeed struct {
+	key     [32]byte
+	leaf    uint32
+	witness uint32
 }
 
 type levelBuffer struct {
@@ -0,0 +1,231 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+// levelBuilder는 bottom-up BFS merge 한 번에 필요한 scratch 상태를 묶는다.
+// writer와 각 commit worker가 하나씩 소유하므로 level buffer와 router lane이 공유되지 않는다.
+type levelBuilder struct {
+	levelBuf levelBuffer
+	router   SIMDRouter
+}
+
+// loadLeaves seeds the level buffer with the batch's leaves: a new leaf for
+// every set, an empty entry for every delete and the old leaf for every
+// displaced seed. Witnesses index the batch-wide mutations and stacks.
+func (b *levelBuilder) loadLeaves(t *StateTree, region *allocRegion, seeds []leafSeed, mutations []Mutation, version uint64) error {
+	b.levelBuf.ensure(len(seeds))
+	curr := b.levelBuf.curr
+
+	for i := range seeds {
+		seed := &seeds[i]
+		if seed.leaf != 0 {
+			curr = append(curr, levelEntry{
+				key:     seed.key,
+				index:   seed.leaf,
+				witness: seed.witness,
+				leaf:    true,
+			})
+			continue
+		}
+
+		mutation := &mutations[seed.witness]
+		leafIndex := uint32(0)
+		if !mutation.Delete {
+			var err error
+			leafIndex, err = t.allocInRegion(region, t.leafNode(mutation.Key, mutation.Value, mutation.blob, version))
+			if err != nil {
+				return err
+			}
+		}
+
+		curr = append(curr, levelEntry{
+			key:     mutation.Key,
+			index:   leafIndex,
+			witness: seed.witness,
+			leaf:    leafIndex != 0,
+		})
+	}
+
+	b.levelBuf.curr = curr
+	return nil
+}
+
+func (t *StateTree) leafNode(key, value [32]byte, blob BlobRef, version uint64) Node {
+	return Node{
+		Hash:    t.hasher.HashLeaf(key, value),
+		Version: version,
+		Prefix:  makePrefix(JMTTreeDepth, true),
+		Value:   value,
+		Blob:    blob,
+		Key:     key,
+	}
+}
+
+// stackAt returns the witness's path stack, or nil when the batch is built
+// on an empty tree without path stacks.
+//
+//go:inline
+func stackAt(stacks []pathStack, witness uint32) *pathStack {
+	if stacks == nil {
+		return nil
+	}
+	return &stacks[witness]
+}
+
+// siblingEntry turns the untouched sibling recorded in a path stack into an
+// entry, so a lone leaf there can move up like a dirty one.
+func siblingEntry(t *StateTree, stack *pathStack, depth int) levelEntry {
+	if stack == nil {
+		return levelEntry{}
+	}
+	index := stack.siblingAt(depth)
+	if index == 0 {
+		return levelEntry{}
+	}
+	if node, _, ok := t.nodeByIndex(index); ok && isLeaf(node.Prefix) {
+		return levelEntry{key: node.Key, index: index, leaf: true}
+	}
+	return levelEntry{index: index}
+}
+
+// mergeLevels folds the current level into parents for every depth from
+// `from` down to `to` (inclusive). Parents missing a dirty child take the
+// sibling recorded in the witness's path stack. A leaf whose sibling is
+// empty gets no parent; it moves up while its key stays unique, so every
+// leaf ends at its shortest unique prefix.
+func (b *levelBuilder) mergeLevels(t *StateTree, region *allocRegion, stacks []pathStack, version uint64, from int, to int) error {
+	router := &b.router
+	for depth := from; depth >= to; depth-- {
+		next := b.levelBuf.next[:0]
+		router.Reset()
+
+		i := 0
+		for i < len(b.levelBuf.curr) {
+			groupStart := i
+			i++
+			for i < len(b.levelBuf.curr) && samePrefix(b.levelBuf.curr[groupStart].key, b.levelBuf.curr[i].key, uint16(depth)) {
+				i++
+			}
+
+			var (
+				hasLeft, hasRight bool
+				left, right       levelEntry
+			)
+			for j := groupStart; j < i; j++ {
+				entry := b.levelBuf.curr[j]
+				if bitAt(entry.key, uint16(depth)) == 0 {
+					hasLeft = true
+					left = entry
+				} else {
+					hasRight = true
+					right = entry
+				}
+			}
+
+			witness := left.witness
+			if !hasLeft {
+				witness = right.witness
+				left = siblingEntry(t, stackAt(stacks, witness), depth)
+			}
+			if !hasRight {
+				right = siblingEntry(t, stackAt(stacks, witness), depth)
+			}
+
+			// 한쪽이 비어 있으면 parent를 만들지 않는다. leaf는 key가 유일한 동안 위로 올라간다.
+			switch {
+			case left.index == 0 && right.index == 0:
+				next = append(next, levelEntry{
+					key:     prefixPath(b.levelBuf.curr[groupStart].key, uint16(depth)),
+					witness: witness,
+				})
+				continue
+			case left.index == 0 && right.leaf:
+				right.witness = witness
+				next = append(next, right)
+				continue
+			case right.index == 0 && left.leaf:
+				left.witness = witness
+				next = append(next, left)
+				continue
+			}
+
+			// router가 늦게 flush해도 level 순서가 key 순서로 유지되도록 자리를 먼저 잡는다.
+			next = append(next, levelEntry{
+				key:     prefixPath(b.levelBuf.curr[groupStart].key, uint16(depth)),
+				index:   0,
+				witness: witness,
+			})
+			leftIndex, rightIndex := left.index, right.index
+
+			meta := pendingParent{
+				leftIndex:  leftIndex,
+				rightIndex: rightIndex,
+				slot:       uint32(len(next) - 1),
+			}
+			full := router.Add(
+				t.nodeHashAtDepth(leftIndex, uint16(depth+1)),
+				t.nodeHashAtDepth(rightIndex, uint16(depth+1)),
+				meta,
+			)
+			if full {
+				hashes, metas := router.Flush()
+				for k := range metas {
+					parentNode := Node{
+						Hash:       hashes[k],
+						Version:    version,
+						Prefix:     makePrefix(uint16(depth), false),
+						LeftIndex:  metas[k].leftIndex,
+						RightIndex: metas[k].rightIndex,
+					}
+					parentIndex, err := t.allocInRegion(region, parentNode)
+					if err != nil {
+						return err
+					}
+					next[metas[k].slot].index = parentIndex
+				}
+			}
+		}
+
+		for j := 0; j < router.count; j++ {
+			pair := router.batch[j]
+			meta := router.meta[j]
+			parentHash := t.hasher.HashParent(pair.Left, pair.Right)
+			parentNode := Node{
+				Hash:       parentHash,
+				Version:    version,
+				Prefix:     makePrefix(uint16(depth), false),
+				LeftIndex:  meta.leftIndex,
+				RightIndex: meta.rightIndex,
+			}
+			parentIndex, err := t.allocInRegion(region, parentNode)
+			if err != nil {
+				return err
+			}
+			next[meta.slot].index = parentIndex
+		}
+		router.Reset()
+
+		b.levelBuf.next = next
+		b.levelBuf.swap()
+	}
+	return nil
+}
+
+// mergeDepths merges binary depths from..to in the tree's layout. In the
+// radix-16 layout both bounds must sit on nibble boundaries (from+1 and to
+// multiples of 4).
+func (b *levelBuilder) mergeDepths(t *StateTree, region *allocRegion, stacks []pathStack, version uint64, from int, to int) error {
+	if t.radix16 {
+		return b.mergeNibbles(t, region, stacks, version, (from+1)/4-1, to/4)
+	}
+	return b.mergeLevels(t, region, stacks, version, from, to)
+}
+
+// root returns the single entry left after merging up to depth 0.
+func (b *levelBuilder) root(t *StateTree) (uint32, [32]byte) {
+	if len(b.levelBuf.curr) == 0 {
+		return 0, t.hasher.ZeroHash(0)
+	}
+	rootIndex := b.levelBuf.curr[0].index
+	return rootIndex, t.nodeHashAtDepth(rootIndex, 0)
+}
@@ -0,0 +1,128 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+// mergeNibbles is the radix-16 counterpart of mergeLevels. It folds the
+// current level into node16 parents for every nibble depth from `from` down
+// to `to` (inclusive). Each parent starts from the node16 recorded in the
+// witness's path stack, so untouched children are carried over as is.
+func (b *levelBuilder) mergeNibbles(t *StateTree, region *allocRegion, stacks []pathStack, version uint64, from int, to int) error {
+	var levels [5][16]subtree
+	for nibble := from; nibble >= to; nibble-- {
+		depth := uint16(4 * nibble)
+		next := b.levelBuf.next[:0]
+
+		i := 0
+		for i < len(b.levelBuf.curr) {
+			groupStart := i
+			i++
+			for i < len(b.levelBuf.curr) && samePrefix(b.levelBuf.curr[groupStart].key, b.levelBuf.curr[i].key, depth) {
+				i++
+			}
+			group := b.levelBuf.curr[groupStart:i]
+			witness := group[0].witness
+
+			old := uint32(0)
+			if stack := stackAt(stacks, witness); stack != nil {
+				old = stack.siblingAt(nibble)
+			}
+			if old != 0 {
+				node, _, ok := t.nodeByIndex(old)
+				if ok && isRadix16(node.Prefix) {
+					t.loadChildren16(asNode16(&node), &levels)
+				} else {
+					levels[4] = [16]subtree{}
+				}
+			} else {
+				levels[4] = [16]subtree{}
+			}
+			for j := range group {
+				entry := &group[j]
+				slot := nibbleAt(entry.key, nibble)
+				switch {
+				case entry.index == 0:
+					levels[4][slot] = subtree{}
+				case entry.leaf:
+					levels[4][slot] = subtree{hash: t.nodeHashAtDepth(entry.index, 0), index: entry.index, kind: subtreeLeaf}
+				default:
+					levels[4][slot] = subtree{hash: t.nodeHashAtDepth(entry.index, 0), index: entry.index, kind: subtreeInner}
+				}
+			}
+			t.fold16(&levels, nibble)
+
+			top := levels[0][0]
+			switch top.kind {
+			case subtreeEmpty:
+				next = append(next, levelEntry{key: prefixPath(group[0].key, depth), witness: witness})
+				continue
+			case subtreeLeaf:
+				leafKey, ok := groupLeafKey(group, top.index)
+				if !ok {
+					node, _, _ := t.nodeByIndex(top.index)
+					leafKey = node.Key
+				}
+				next = append(next, levelEntry{key: leafKey, index: top.index, witness: witness, leaf: true})
+				continue
+			}
+
+			var parent node16
+			parent.Hash = top.hash
+			parent.Version = version
+			parent.Prefix = makePrefix(depth, false) | radix16BitMask
+			for slot := range levels[4] {
+				child := &levels[4][slot]
+				if child.kind == subtreeEmpty {
+					continue
+				}
+				parent.Children[slot] = child.index
+				parent.Bitmap |= 1 << slot
+				if child.kind == subtreeLeaf {
+					parent.LeafBitmap |= 1 << slot
+				}
+			}
+			parentIndex, err := t.allocInRegion(region, parent.node())
+			if err != nil {
+				return err
+			}
+			next = append(next, levelEntry{key: prefixPath(group[0].key, depth), index: parentIndex, witness: witness})
+		}
+
+		b.levelBuf.next = next
+		b.levelBuf.swap()
+	}
+	return nil
+}
+
+func groupLeafKey(group []levelEntry, index uint32) ([32]byte, bool) {
+	for i := range group {
+		if group[i].index == index {
+			return group[i].key, true
+		}
+	}
+	return [32]byte{}, false
+}
+
+// fillPathStack16 records the node16 met at every nibble depth of key's path;
+// sibling[d] is the node at nibble depth d, not its sibling.
+func fillPathStack16(t *StateTree, rootIndex uint32, key [32]byte, stack *pathStack) {
+	stack.leaf = 0
+	current := rootIndex
+	nibble := 0
+	for ; current != 0 && nibble <= radix16Nibbles; nibble++ {
+		node, _, ok := t.nodeByIndex(current)
+		if !ok {
+			break
+		}
+		if isLeaf(node.Prefix) {
+			stack.leaf = current
+			stack.leafKey = node.Key
+			break
+		}
+		if nibble == radix16Nibbles {
+			break
+		}
+		stack.sibling[nibble] = current
+		current = asNode16(&node).Children[nibbleAt(key, nibble)]
+	}
+	stack.depth = uint16(min(nibble, radix16Nibbles))
+}
@@ -13,5 +13,12 @@ type Node struct {
 	LeftIndex  uint32
 	RightIndex uint32
 
-	_padding [72]byte
+	// Value는 leaf에만 채워진다. leaf와 같은 epoch arena에 살기 때문에
+	// 값의 버전과 수명이 leaf를 따라간다.
+	Value [32]byte
+	// Blob은 가변 길이 API로 쓴 leaf의 원래 key/value 레코드다.
+	Blob BlobRef
+	// Key는 leaf의 전체 경로다. leaf는 유일해지는 가장 얕은 depth에 놓이므로
+	// 위치만으로는 key를 복원할 수 없다.
+	Key [32]byte
 }
@@ -0,0 +1,150 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"unsafe"
+
+	"github.com/Pam-La/jmt_for_mac/internal/proof"
+)
+
+// node16은 Aptos/Sui JMT처럼 nibble 하나로 자식을 고르는 radix-16 internal 노드다.
+// Node와 같은 128B 슬롯에 들어가며 LeftIndex부터의 바이트를 자식 인덱스와 bitmap으로 다시 해석한다.
+// Hash는 자식 16개 위의 4단 binary 서브트리 루트라서 binary 트리와 루트가 같다.
+type node16 struct {
+	Hash    [32]byte
+	Version uint64
+	Prefix  uint64
+
+	Children [16]uint32
+	// Bitmap은 비어 있지 않은 자식, LeafBitmap은 그중 leaf인 자식이다.
+	Bitmap     uint16
+	LeafBitmap uint16
+	_          [12]byte
+}
+
+const radix16Nibbles = JMTTreeDepth / 4
+
+//go:inline
+func asNode16(n *Node) *node16 {
+	return (*node16)(unsafe.Pointer(n))
+}
+
+//go:inline
+func (n *node16) node() Node {
+	return *(*Node)(unsafe.Pointer(n))
+}
+
+//go:inline
+func nibbleAt(key [32]byte, nibble int) int {
+	b := key[nibble/2]
+	if nibble%2 == 0 {
+		return int(b >> 4)
+	}
+	return int(b & 0x0F)
+}
+
+// childSlots writes the children of an internal node to out in key order,
+// empty slots included, and returns the fan-out (2, 16, or 0 for a leaf).
+// It hides the node's radix from traversals.
+func childSlots(node *Node, out *[16]uint32) int {
+	if isLeaf(node.Prefix) {
+		return 0
+	}
+	if !isRadix16(node.Prefix) {
+		out[0] = node.LeftIndex
+		out[1] = node.RightIndex
+		return 2
+	}
+	*out = asNode16(node).Children
+	return 16
+}
+
+// subtree is one position of the 4-level binary tree folded inside a node16.
+type subtree struct {
+	hash  [32]byte
+	index uint32 // leaf index when kind == subtreeLeaf
+	kind  uint8
+}
+
+const (
+	subtreeEmpty uint8 = iota
+	subtreeLeaf
+	subtreeInner
+)
+
+// fold16 hashes the binary levels inside a node16 at nibble depth nibble.
+// levels[k] holds the 2^k subtrees at binary depth 4*nibble+k and levels[4]
+// must already hold the children. A lone leaf floats up exactly as in the
+// binary layout, so both layouts commit to the same root.
+func (t *StateTree) fold16(levels *[5][16]subtree, nibble int) {
+	base := uint16(4 * nibble)
+	for k := 3; k >= 0; k-- {
+		childDepth := base + uint16(k) + 1
+		width := 1 << k
+		for i := 0; i < width; i++ {
+			left := &levels[k+1][2*i]
+			right := &levels[k+1][2*i+1]
+			out := &levels[k][i]
+			switch {
+			case left.kind == subtreeEmpty && right.kind == subtreeEmpty:
+				*out = subtree{}
+			case left.kind == subtreeEmpty && right.kind == subtreeLeaf:
+				*out = *right
+			case right.kind == subtreeEmpty && left.kind == subtreeLeaf:
+				*out = *left
+			default:
+				lh, rh := left.hash, right.hash
+				if left.kind == subtreeEmpty {
+					lh = t.hasher.ZeroHash(childDepth)
+				}
+				if right.kind == subtreeEmpty {
+					rh = t.hasher.ZeroHash(childDepth)
+				}
+				*out = subtree{hash: t.hasher.HashParent(lh, rh), kind: subtreeInner}
+			}
+		}
+	}
+}
+
+// loadChildren16 fills levels[4] from a stored node16.
+func (t *StateTree) loadChildren16(n16 *node16, levels *[5][16]subtree) {
+	for i := range n16.Children {
+		index := n16.Children[i]
+		if index == 0 {
+			levels[4][i] = subtree{}
+			continue
+		}
+		kind := subtreeInner
+		if n16.LeafBitmap&(1<<i) != 0 {
+			kind = subtreeLeaf
+		}
+		levels[4][i] = subtree{hash: t.nodeHashAtDepth(index, 0), index: index, kind: kind}
+	}
+}
+
+// proofThrough16 appends the binary siblings inside n16, which sits at
+// binary depth depth, to p. It returns the next node on key's path and its
+// depth; when the path ends inside n16 the returned index is the leaf that
+// ends it (or 0 for an empty slot) at the depth where the binary layout
+// would have placed it.
+func (t *StateTree) proofThrough16(p *proof.MerkleProof, n16 *node16, key [32]byte, depth int) (uint32, int) {
+	var levels [5][16]subtree
+	t.loadChildren16(n16, &levels)
+	t.fold16(&levels, depth/4)
+
+	nib := nibbleAt(key, depth/4)
+	for k := 0; k < 4; k++ {
+		cur := levels[k][nib>>(4-k)]
+		if cur.kind != subtreeInner {
+			return cur.index, depth + k
+		}
+		partner := levels[k+1][(nib>>(3-k))^1]
+		if partner.kind == subtreeEmpty {
+			p.Siblings[depth+k] = t.hasher.ZeroHash(uint16(depth + k + 1))
+		} else {
+			p.Siblings[depth+k] = partner.hash
+		}
+	}
+	return levels[4][nib].index, depth + 4
+}
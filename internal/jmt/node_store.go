@@ -0,0 +1,131 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import "iter"
+
+// NodeStore keeps the nodes and leaf blobs of every epoch. The tree owns the
+// rest: global indices and their locator directory, versions, and deciding
+// when an epoch can go. A store only hands out epoch storage and takes it
+// back, so tiered or persistent backends plug in through Config.NodeStore
+// without touching the updater or readers. The default keeps every epoch in
+// a Go arena; NewFileNodeStore keeps them in a file.
+type NodeStore interface {
+	// NewEpoch returns empty storage for epoch id with room for at least
+	// capacity slots. Slot 0 is never used, so Head starts at 1.
+	NewEpoch(id uint64, capacity int) (EpochStore, error)
+	// ReleaseEpoch takes back an epoch that no tree and no reader reaches.
+	ReleaseEpoch(epoch EpochStore)
+	// Close releases what the store still holds. The tree calls it from
+	// Close after releasing its epochs.
+	Close() error
+	// Err returns the first error any of its epochs hit reading a node or
+	// blob, or nil. NodeAt and Blob report such a read as a missing slot, so
+	// the tree checks Err before it publishes a version or returns a proof.
+	Err() error
+}
+
+// EpochStore is the node slots and blob records of one epoch. Only the
+// writer changes it, but readers call NodeAt and Blob concurrently for slots
+// and records published before they started.
+type EpochStore interface {
+	ID() uint64
+	Capacity() int
+	// Head is one past the last reserved slot. Truncate moves it back when a
+	// batch fails or a version is rolled back.
+	Head() uint32
+	Truncate(head uint32)
+	// Reserve claims n consecutive slots and returns the first, or
+	// ErrArenaFull if fewer are left. Builders fill disjoint reserved ranges
+	// with StoreAt concurrently.
+	Reserve(n uint32) (uint32, error)
+	StoreAt(slot uint32, node Node) error
+	NodeAt(slot uint32) (Node, bool)
+	// Nodes yields the slots below Head in order, for stores that move
+	// epochs between tiers.
+	Nodes() iter.Seq2[uint32, Node]
+	// AppendBlob stores the original key and value of a KV leaf. Blob
+	// returns them; the slices may alias the store or *scratch and must not
+	// be changed. A store that copies records out reads them into *scratch,
+	// growing it when it is too small, so callers keep one per goroutine.
+	AppendBlob(key []byte, value []byte) (BlobRef, error)
+	Blob(ref BlobRef, scratch *[]byte) ([]byte, []byte, bool)
+	// BlobMark and TruncateBlobs save and restore the blob cursor like Head
+	// and Truncate.
+	BlobMark() BlobMark
+	TruncateBlobs(mark BlobMark)
+}
+
+// BlobMark is an opaque blob cursor of an EpochStore.
+type BlobMark uint64
+
+//go:inline
+func remaining(epoch EpochStore) int {
+	return epoch.Capacity() - int(epoch.Head())
+}
+
+// appendNode stores node in the next free slot of epoch.
+func appendNode(epoch EpochStore, node Node) (uint32, error) {
+	slot, err := epoch.Reserve(1)
+	if err != nil {
+		return 0, err
+	}
+	if err := epoch.StoreAt(slot, node); err != nil {
+		epoch.Truncate(slot)
+		return 0, err
+	}
+	return slot, nil
+}
+
+// arenaStore is the default NodeStore. Released arenas go to a small warm
+// pool and back out for new epochs that fit, so steady commits do not
+// allocate arenas.
+type arenaStore struct {
+	pool        []*EpochArena
+	maxPoolSize int
+}
+
+func newArenaStore(initialArenaCapacity int) *arenaStore {
+	s := &arenaStore{
+		pool:        make([]*EpochArena, 0, warmPoolMaxSize),
+		maxPoolSize: warmPoolMaxSize,
+	}
+	for i := 0; i < warmPoolBootstrapCount; i++ {
+		s.pool = append(s.pool, newEpochArena(0, initialArenaCapacity))
+	}
+	return s
+}
+
+func (s *arenaStore) NewEpoch(id uint64, capacity int) (EpochStore, error) {
+	if n := len(s.pool); n > 0 {
+		ep := s.pool[n-1]
+		if ep.Capacity() >= capacity {
+			s.pool = s.pool[:n-1]
+			_ = ep.ResetForReuse(id)
+			return ep, nil
+		}
+	}
+	return newEpochArena(id, capacity), nil
+}
+
+func (s *arenaStore) ReleaseEpoch(epoch EpochStore) {
+	ep := epoch.(*EpochArena)
+	if len(s.pool) < s.maxPoolSize && !ep.IsFreed() {
+		_ = ep.ResetForReuse(0)
+		s.pool = append(s.pool, ep)
+		return
+	}
+	ep.Free()
+}
+
+func (s *arenaStore) Err() error {
+	return nil
+}
+
+func (s *arenaStore) Close() error {
+	for _, ep := range s.pool {
+		ep.Free()
+	}
+	s.pool = nil
+	return nil
+}
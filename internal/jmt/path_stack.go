@@ -3,24 +3,43 @@
 package jmt
 
 // pathStack은 root->leaf down-pass에서 각 depth의 sibling 인덱스를 보관한다.
-// sibling은 이전 버전 루트 기준 global node index다.
+// sibling은 이전 버전 루트 기준 global node index다. 경로는 빈 자식이나 leaf를
+// 만나는 depth에서 끝나며, 그 아래 sibling은 모두 비어 있다.
 type pathStack struct {
 	sibling [JMTTreeDepth]uint32
+	depth   uint16
+	leaf    uint32
+	leafKey [32]byte
 }
 
-func (u *BatchUpdater) fillPathStack(t *StateTree, rootIndex uint32, key [32]byte, stack *pathStack) {
-	current := rootIndex
-	for depth := 0; depth < JMTTreeDepth; depth++ {
-		if current == 0 {
-			stack.sibling[depth] = 0
-			continue
-		}
+//go:inline
+func (s *pathStack) siblingAt(depth int) uint32 {
+	if depth >= int(s.depth) {
+		return 0
+	}
+	return s.sibling[depth]
+}
 
+func fillPathStack(t *StateTree, rootIndex uint32, key [32]byte, stack *pathStack) {
+	if t.radix16 {
+		fillPathStack16(t, rootIndex, key, stack)
+		return
+	}
+	stack.leaf = 0
+	current := rootIndex
+	depth := 0
+	for ; current != 0 && depth <= JMTTreeDepth; depth++ {
 		node, _, ok := t.nodeByIndex(current)
 		if !ok {
-			stack.sibling[depth] = 0
-			current = 0
-			continue
+			break
+		}
+		if isLeaf(node.Prefix) {
+			stack.leaf = current
+			stack.leafKey = node.Key
+			break
+		}
+		if depth == JMTTreeDepth {
+			break
 		}
 
 		if bitAt(key, uint16(depth)) == 0 {
@@ -31,4 +50,5 @@ func (u *BatchUpdater) fillPathStack(t *StateTree, rootIndex uint32, key [32]byt
 			current = node.RightIndex
 		}
 	}
+	stack.depth = uint16(min(depth, JMTTreeDepth))
 }
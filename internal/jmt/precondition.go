@@ -0,0 +1,73 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Precondition is what a mutation requires of its key in the base version.
+type Precondition uint8
+
+const (
+	RequireNone Precondition = iota
+	// RequireLeafHash requires the key's current leaf hash to equal
+	// Mutation.ExpectedLeafHash.
+	RequireLeafHash
+	RequireExists
+	RequireAbsent
+)
+
+var ErrPreconditionFailed = errors.New("mutation precondition failed")
+
+// PreconditionError rejects a whole batch. Keys lists, in batch order, the
+// keys whose preconditions did not hold; errors.Is matches
+// ErrPreconditionFailed.
+type PreconditionError struct {
+	Keys [][32]byte
+}
+
+func (e *PreconditionError) Error() string {
+	if len(e.Keys) == 1 {
+		return fmt.Sprintf("%v: key %x", ErrPreconditionFailed, e.Keys[0])
+	}
+	return fmt.Sprintf("%v: %d keys, first %x", ErrPreconditionFailed, len(e.Keys), e.Keys[0])
+}
+
+func (e *PreconditionError) Is(target error) bool {
+	return target == ErrPreconditionFailed
+}
+
+// checkPreconditions evaluates every mutation's precondition against the
+// tree at baseRoot. It runs before anything is written, so a rejected batch
+// leaves no trace in the epoch or the locator.
+func (t *StateTree) checkPreconditions(baseRoot uint32, mutations []Mutation) error {
+	var failed *PreconditionError
+	for i := range mutations {
+		m := &mutations[i]
+		if m.Require == RequireNone {
+			continue
+		}
+		leaf, _, exists := t.lookupLeaf(baseRoot, m.Key)
+		var ok bool
+		switch m.Require {
+		case RequireLeafHash:
+			ok = exists && leaf.Hash == m.ExpectedLeafHash
+		case RequireExists:
+			ok = exists
+		case RequireAbsent:
+			ok = !exists
+		}
+		if !ok {
+			if failed == nil {
+				failed = &PreconditionError{}
+			}
+			failed.Keys = append(failed.Keys, m.Key)
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
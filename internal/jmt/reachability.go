@@ -0,0 +1,126 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import "math"
+
+// liveCandidate is an epoch without versions whose nodes may still be
+// shared by the trees of newer versions.
+type liveCandidate struct {
+	epochID uint64
+	floor   uint64
+	live    int
+	// move marks the epochs Compact relocates.
+	move bool
+}
+
+// retireUnreachableLocked retires the orphan epochs that no retained root,
+// branch or staged batch reaches any more. Orphans that still hold shared
+// nodes stay orphans and are checked again when the next epoch is orphaned,
+// so the mark walk runs about once per epoch rather than once per commit.
+func (t *StateTree) retireUnreachableLocked() {
+	orphans := t.versions.orphanEpochs
+	candidates := t.versions.liveScratch[:0]
+	for _, epochID := range orphans {
+		// 그 사이 새 버전이 이 epoch에 들어왔으면 더 이상 후보가 아니다.
+		if cnt, ok := t.versions.epochRefcount[epochID]; !ok || cnt != 0 {
+			continue
+		}
+		candidates = append(candidates, liveCandidate{epochID: epochID, floor: t.versions.epochFloor[epochID]})
+	}
+	t.versions.liveScratch = candidates
+	t.versions.orphanEpochs = orphans[:0]
+	if len(candidates) == 0 {
+		t.versions.orphansChecked = 0
+		return
+	}
+
+	t.markLiveLocked(candidates, nil)
+
+	// 버전을 모두 끊은 뒤 seq를 올려야 이후에 들어온 reader가 이 epoch을 볼 수 없다.
+	seq := t.versions.publishSeq.Add(1)
+	for _, c := range candidates {
+		if c.live > 0 {
+			t.versions.orphanEpochs = append(t.versions.orphanEpochs, c.epochID)
+			continue
+		}
+		t.versions.retired = append(t.versions.retired, retiredEpoch{epochID: c.epochID, seq: seq, floor: c.floor})
+	}
+	t.versions.orphansChecked = len(t.versions.orphanEpochs)
+}
+
+// markLiveLocked counts, for every candidate epoch, the nodes reachable from
+// the retained roots and, when collect is not nil, appends them to it. A
+// node written at version w only points at nodes written at or before w,
+// and a candidate holds no node older than its floor, so subtrees below the
+// oldest floor are skipped.
+func (t *StateTree) markLiveLocked(candidates []liveCandidate, collect *[]liveNode) {
+	minFloor := uint64(math.MaxUint64)
+	for _, c := range candidates {
+		minFloor = min(minFloor, c.floor)
+	}
+	words := int(t.locatorHighLocked()>>6) + 1
+	if cap(t.versions.markBits) < words {
+		// locator는 commit마다 자라므로 매 walk 다시 잡지 않도록 여유를 둔다.
+		t.versions.markBits = make([]uint64, words, max(words+words/2, 2*cap(t.versions.markBits)))
+	}
+	m := marker{tree: t, bits: t.versions.markBits[:words], candidates: candidates, minFloor: minFloor, collect: collect}
+
+	for _, ref := range t.versions.versionRoots {
+		m.mark(ref.rootIndex)
+	}
+	for _, b := range t.versions.branches {
+		for _, ref := range b.versions {
+			m.mark(ref.rootIndex)
+		}
+	}
+	if s := t.updater.staged; s != nil {
+		m.mark(s.snapshot.RootIndex)
+	}
+	clear(m.bits)
+}
+
+// liveNode is a reachable node of candidate epoch candidates[candidate].
+type liveNode struct {
+	index     uint32
+	candidate int32
+}
+
+type marker struct {
+	tree       *StateTree
+	bits       []uint64
+	candidates []liveCandidate
+	minFloor   uint64
+	collect    *[]liveNode
+}
+
+func (m *marker) mark(index uint32) {
+	if index == 0 || int(index>>6) >= len(m.bits) {
+		return
+	}
+	word, bit := index>>6, uint64(1)<<(index&63)
+	if m.bits[word]&bit != 0 {
+		return
+	}
+	m.bits[word] |= bit
+
+	node, epoch, ok := m.tree.nodeByIndex(index)
+	if !ok || node.Version < m.minFloor {
+		return
+	}
+	id := epoch.ID()
+	for i := range m.candidates {
+		if m.candidates[i].epochID == id {
+			m.candidates[i].live++
+			if m.collect != nil {
+				*m.collect = append(*m.collect, liveNode{index: index, candidate: int32(i)})
+			}
+			break
+		}
+	}
+	var children [16]uint32
+	width := childSlots(&node, &children)
+	for s := 0; s < width; s++ {
+		m.mark(children[s])
+	}
+}
@@ -0,0 +1,38 @@
+//go:build goexperiment.arenas && amd64
+
+package jmt
+
+import (
+	"testing"
+
+	"github.com/Pam-La/jmt_for_mac/internal/hash"
+)
+
+func TestCommitRunsAMD64Kernels(t *testing.T) {
+	tree := NewStateTree(Config{
+		InitialArenaCapacity: 1 << 16,
+		RetainVersions:       2,
+		SIMDLanes:            8,
+	})
+	defer tree.Close()
+
+	// CPU에 AVX가 없거나 JMT_DISABLE_ASM=1이면 커널이 돌지 않는다.
+	var out [4][32]byte
+	var pairs [4]hash.ParentPair
+	tree.Hasher().CompressParentsX4(&out, &pairs)
+	if tree.HashStats().ASMCalls == 0 {
+		t.Skip("no amd64 vector kernel on this CPU")
+	}
+
+	mutations := make([]Mutation, 4096)
+	for i := range mutations {
+		mutations[i] = Mutation{Key: keyFromUint32(uint32(i) * 2654435761), Value: fixedWord(byte(i))}
+	}
+	tree.Hasher().ResetStats()
+	if _, err := tree.ApplyBatch(mutations); err != nil {
+		t.Fatalf("apply batch failed: %v", err)
+	}
+	if stats := tree.HashStats(); stats.ASMCalls == 0 || stats.ParentSIMDPairs() == 0 {
+		t.Fatalf("commit ran no vector kernel: %+v", stats)
+	}
+}
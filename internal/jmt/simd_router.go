@@ -4,18 +4,36 @@ package jmt
 
 import "github.com/Pam-La/jmt_for_mac/internal/hash"
 
-// SIMDRouter batches parent pairs and routes full chunks to the x4 path.
+// SIMDRouter batches parent pairs and routes full chunks to the multi-lane
+// entry point matching its configured width (4, 8 or 16 lanes).
+// It lives inside BatchUpdater so the lane buffers handed to the hasher stay
+// off the stack and the interface call does not force an allocation.
 type SIMDRouter struct {
-	hasher *hash.Engine
-	batch  [SIMDChunkSize]hash.ParentPair
-	meta   [SIMDChunkSize]pendingParent
-	out    [SIMDChunkSize][32]byte
+	hasher hash.Hasher
+	width  int
+	batch  [MaxSIMDLanes]hash.ParentPair
+	meta   [MaxSIMDLanes]pendingParent
+	out    [MaxSIMDLanes][32]byte
 	count  int
 }
 
 //go:inline
-func newSIMDRouter(hasher *hash.Engine) SIMDRouter {
-	return SIMDRouter{hasher: hasher}
+func newSIMDRouter(hasher hash.Hasher, width int) SIMDRouter {
+	return SIMDRouter{hasher: hasher, width: width}
+}
+
+func validSIMDLanes(width int) bool {
+	switch width {
+	case 4, 8, 16:
+		return true
+	default:
+		return false
+	}
+}
+
+//go:inline
+func (r *SIMDRouter) Width() int {
+	return r.width
 }
 
 //go:inline
@@ -24,16 +42,25 @@ func (r *SIMDRouter) Add(left [32]byte, right [32]byte, meta pendingParent) bool
 	r.batch[idx] = hash.ParentPair{Left: left, Right: right}
 	r.meta[idx] = meta
 	r.count++
-	return r.count == SIMDChunkSize
+	return r.count == r.width
 }
 
-func (r *SIMDRouter) FlushX4() (*[SIMDChunkSize][32]byte, *[SIMDChunkSize]pendingParent) {
-	if r.count != SIMDChunkSize {
+// Flush hashes a full chunk and returns the outputs and metadata, both of
+// length Width(). It returns nil slices if the chunk is not full.
+func (r *SIMDRouter) Flush() ([][32]byte, []pendingParent) {
+	if r.count != r.width {
 		return nil, nil
 	}
-	r.hasher.CompressParentsX4(&r.out, &r.batch)
+	switch r.width {
+	case 4:
+		r.hasher.CompressParentsX4((*[4][32]byte)(r.out[:4]), (*[4]hash.ParentPair)(r.batch[:4]))
+	case 8:
+		r.hasher.CompressParentsX8((*[8][32]byte)(r.out[:8]), (*[8]hash.ParentPair)(r.batch[:8]))
+	case 16:
+		r.hasher.CompressParentsX16(&r.out, &r.batch)
+	}
 	r.count = 0
-	return &r.out, &r.meta
+	return r.out[:r.width], r.meta[:r.width]
 }
 
 //go:inline
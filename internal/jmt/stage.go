@@ -0,0 +1,160 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"sync"
+
+	"github.com/Pam-La/jmt_for_mac/internal/proof"
+)
+
+// StagedBatch is a batch written by Stage but not yet published. Its nodes
+// are already in the main head's epoch, so proofs against the would-be root
+// cost the same as for a committed version. Until Commit or Discard is
+// called, every other write to the main head fails with ErrStagePending.
+type StagedBatch struct {
+	tree     *StateTree
+	snapshot Snapshot
+	ref      rootRef
+	undo     batchUndo
+	// mu orders reads against the staged root with Commit and Discard, which
+	// set done under its write lock.
+	mu   sync.RWMutex
+	done bool
+	// log is the batch's write-ahead log payload, written on Commit.
+	log []byte
+}
+
+// Stage writes mutations on top of the latest version without publishing
+// them. An empty batch stages the latest version unchanged.
+func (t *StateTree) Stage(mutations []Mutation) (*StagedBatch, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if t.updater.staged != nil {
+		return nil, ErrStagePending
+	}
+	current := t.versions.latest.Load()
+	if current == nil {
+		return nil, ErrUnknownVersion
+	}
+	if err := t.checkPreconditions(current.RootIndex, mutations); err != nil {
+		return nil, err
+	}
+	s := &StagedBatch{tree: t, snapshot: *current}
+	normalized := t.updater.dirtyQueue.normalize(mutations)
+	if len(normalized) == 0 {
+		// 쓴 것이 없으므로 undo.epoch은 nil이고 Commit은 latest를 그대로 돌려준다.
+		t.updater.staged = s
+		return s, nil
+	}
+
+	nextVersion := current.Version + 1
+	ref, undo, err := t.commitLocked(current.RootIndex, normalized, nextVersion, &t.memory.activeEpoch)
+	if err != nil {
+		return nil, err
+	}
+	s.snapshot = ref.snapshot(nextVersion)
+	s.ref = ref
+	s.undo = undo
+	if t.wal != nil {
+		s.log = appendWALBatch(nil, nextVersion, ref.rootHash, normalized)
+	}
+	t.updater.staged = s
+	return s, nil
+}
+
+// Commit publishes the staged batch as the latest version.
+func (s *StagedBatch) Commit() (Snapshot, error) {
+	t := s.tree
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if s.done {
+		return Snapshot{}, ErrStageClosed
+	}
+	if s.log != nil && t.wal != nil {
+		// 기록하지 못하면 staged 상태로 남겨 Discard할 수 있게 한다.
+		t.wal.buf = append(t.wal.buf[:0], s.log...)
+		if err := t.logLocked(); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	s.close()
+	t.updater.staged = nil
+	if s.undo.epoch == nil {
+		return s.snapshot, nil
+	}
+	return t.publishLocked(s.snapshot.Version, s.ref), nil
+}
+
+// Discard drops the staged batch. Its nodes and blobs are truncated from the
+// epoch and its global node indices are handed back to the next commit, as
+// when ApplyBatch fails.
+func (s *StagedBatch) Discard() error {
+	t := s.tree
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	if s.done {
+		return ErrStageClosed
+	}
+	s.close()
+	t.updater.staged = nil
+	if s.undo.epoch != nil {
+		s.undo.undo(t)
+	}
+	return nil
+}
+
+// Snapshot returns the would-be version. Its nodes are only readable until
+// the batch is discarded.
+func (s *StagedBatch) Snapshot() Snapshot {
+	return s.snapshot
+}
+
+func (s *StagedBatch) RootHash() [32]byte {
+	return s.snapshot.RootHash
+}
+
+// GenerateProof proves key against the staged root. After Commit or Discard
+// it returns an empty proof; read the committed version through a ReadTxn.
+func (s *StagedBatch) GenerateProof(key [32]byte) proof.MerkleProof {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.done {
+		return proof.MerkleProof{}
+	}
+	txn := s.txn()
+	defer txn.Release()
+	return txn.GenerateProof(key)
+}
+
+// Get reads key at the staged root. After Commit or Discard it reports false.
+func (s *StagedBatch) Get(key [32]byte) ([32]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.done {
+		return [32]byte{}, false
+	}
+	txn := s.txn()
+	defer txn.Release()
+	return txn.Get(key)
+}
+
+// close marks the batch done once no read against the staged root is running.
+func (s *StagedBatch) close() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+}
+
+// txn opens a read transaction at the staged root. It holds a reader slot, so
+// Compact keeps the arenas it moves nodes out of until the read is done. The
+// caller holds s.mu for reading, so Discard cannot truncate the nodes, and
+// releases the transaction.
+func (s *StagedBatch) txn() ReadTxn {
+	slot := s.tree.enterReader()
+	slot.observe(s.snapshot.Version)
+	return ReadTxn{tree: s.tree, snapshot: &s.snapshot, slot: slot}
+}
@@ -1,6 +1,6 @@
-//go:build !darwin || !arm64
+//go:build !(darwin && arm64) && !(amd64 && (linux || darwin))
 
 package jmt
 
-// 엄격 모드: Apple Silicon 전용.
-var _ = requiresDarwinArm64Target
+// 엄격 모드: Apple Silicon과 amd64(linux, darwin)만 지원한다.
+var _ = requiresSupportedTarget
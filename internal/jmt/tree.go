@@ -6,20 +6,74 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Pam-La/jmt_for_mac/internal/hash"
 )
 
 var (
-	ErrUnknownVersion   = errors.New("unknown version")
-	ErrNodeIndexExhaust = errors.New("global node index exhausted")
-	ErrEpochIDOverflow  = errors.New("epoch ID exceeds uint32")
+	ErrUnknownVersion     = errors.New("unknown version")
+	ErrNodeIndexExhaust   = errors.New("global node index exhausted")
+	ErrEpochIDOverflow    = errors.New("epoch ID exceeds uint32")
+	ErrUnknownBranch      = errors.New("unknown branch")
+	ErrBranchExists       = errors.New("branch already exists")
+	ErrVersionPinned      = errors.New("version is the base of a branch")
+	ErrStagePending       = errors.New("a staged batch is pending")
+	ErrStageClosed        = errors.New("staged batch already committed or discarded")
+	ErrTreeNotEmpty       = errors.New("tree is not empty")
+	ErrUnsortedInput      = errors.New("bulk load keys are not strictly ascending")
+	ErrBulkCount          = errors.New("bulk load entry count mismatch")
+	ErrRootMismatch       = errors.New("root does not match expected root")
+	ErrNoWAL              = errors.New("no write-ahead log path configured")
+	ErrWALCorrupt         = errors.New("write-ahead log record is malformed")
+	ErrWALRecordSize      = errors.New("write-ahead log record exceeds 4 GiB")
+	ErrWALPath            = errors.New("Config.WALPath is only opened by Recover")
+	ErrWALBase            = errors.New("version is before the write-ahead log's base")
+	ErrCheckpointFormat   = errors.New("malformed checkpoint")
+	ErrCheckpointChecksum = errors.New("checkpoint checksum mismatch")
+	ErrCheckpointBase     = errors.New("incremental checkpoint does not continue its base")
+	ErrMissingNode        = errors.New("node is missing from the node store")
 )
 
 type Config struct {
 	InitialArenaCapacity int
 	RetainVersions       uint64
 	HashKey              [32]byte
+	// HashScheme picks the built-in backend keyed with HashKey. It defaults
+	// to keyed BLAKE3 and is ignored when Hasher is set. hash.SchemeAptos
+	// hashes like Aptos and ignores HashKey.
+	HashScheme hash.Scheme
+	Hasher     hash.Hasher
+	// SIMDLanes is the parent batch width (4, 8 or 16); 0 selects SIMDChunkSize.
+	SIMDLanes int
+	// CommitWorkers is the number of cores that hash a large batch; 0 or 1
+	// keeps commits on the writer goroutine and a negative value selects
+	// GOMAXPROCS. Helper goroutines live until Close, and a custom Hasher
+	// must then be safe for concurrent use.
+	CommitWorkers int
+	// Radix is the internal node fan-out: 2 (the default when 0) or 16 for
+	// Aptos/Sui-style nibble nodes. Both layouts commit to the same root and
+	// proofs; radix 16 trades the SIMD parent router for 4x shorter walks.
+	Radix int
+	// CompactInterval, when positive, runs Compact on a background goroutine
+	// every interval with CompactBudget (10ms when 0) until Close. OnCompact,
+	// if set, receives the stats of every pass that released an epoch.
+	// Commits already compact once enough epochs are pinned by shared
+	// nodes; the background pass only reclaims them sooner.
+	CompactInterval time.Duration
+	CompactBudget   time.Duration
+	OnCompact       func(CompactStats)
+	// WALPath is the write-ahead log opened by Recover. NewStateTree panics
+	// and LoadCheckpoint fails with ErrWALPath when it is set, since neither
+	// would replay or keep the log. WALGroupSize syncs the log every that
+	// many records, so a crash may lose up to that many versions; 0 or 1
+	// syncs each record before its version is published.
+	WALPath      string
+	WALGroupSize int
+	// NodeStore holds the nodes of every epoch; nil keeps them in Go arenas.
+	// The tree closes it on Close, which returns the store's close error, so
+	// a store serves one tree.
+	NodeStore NodeStore
 }
 
 type Snapshot struct {
@@ -33,6 +87,22 @@ type rootRef struct {
 	epochID   uint64
 	rootIndex uint32
 	rootHash  [32]byte
+
+	// 커밋 직후의 epoch head, blob cursor와 nextLocator, 그 run의 끝. Rollback이
+	// 이후 버전이 쓴 공간을 되돌릴 때 쓴다.
+	head        uint32
+	blobs       BlobMark
+	nextLocator uint32
+	locatorEnd  uint32
+}
+
+func (r rootRef) snapshot(version uint64) Snapshot {
+	return Snapshot{
+		Version:   version,
+		EpochID:   r.epochID,
+		RootIndex: r.rootIndex,
+		RootHash:  r.rootHash,
+	}
 }
 
 type nodeLocator struct {
@@ -46,41 +116,164 @@ type locatorStore struct {
 	chunks []atomic.Pointer[locatorChunk]
 }
 
+// epochRingSlot holds the live epochs whose ID falls in this slot of the
+// ring. Readers look them up without locks. Usually a slot holds one epoch,
+// kept inline; epoch 1 is never recycled and a pinned epoch can outlive a
+// full turn of IDs, so the others go to spill, a list that is replaced,
+// never changed.
+//
+// The inline epoch is written before its ID is published and rewritten only
+// after the ID is cleared, when no reader can still be looking for it.
+// Readers that find another ID there never touch the epoch field.
 type epochRingSlot struct {
-	epochID atomic.Uint64
-	arena   atomic.Pointer[EpochArena]
+	id    atomic.Uint64
+	epoch EpochStore
+	spill atomic.Pointer[[]ringEntry]
+}
+
+// ringEntry keeps the ID next to the epoch: a reader holding an old list
+// must not call ID on an epoch the store has since reset for reuse.
+type ringEntry struct {
+	id    uint64
+	epoch EpochStore
+}
+
+func (s *epochRingSlot) publish(epoch EpochStore) {
+	if s.id.Load() == 0 {
+		s.epoch = epoch
+		s.id.Store(epoch.ID())
+		return
+	}
+	var list []ringEntry
+	if old := s.spill.Load(); old != nil {
+		list = append(list, *old...)
+	}
+	list = append(list, ringEntry{id: epoch.ID(), epoch: epoch})
+	s.spill.Store(&list)
+}
+
+func (s *epochRingSlot) unpublish(epochID uint64) {
+	if s.id.Load() == epochID {
+		s.id.Store(0)
+		return
+	}
+	old := s.spill.Load()
+	if old == nil {
+		return
+	}
+	list := make([]ringEntry, 0, len(*old))
+	for _, e := range *old {
+		if e.id != epochID {
+			list = append(list, e)
+		}
+	}
+	if len(list) == 0 {
+		s.spill.Store(nil)
+		return
+	}
+	s.spill.Store(&list)
+}
+
+//go:inline
+func (s *epochRingSlot) lookup(epochID uint64) EpochStore {
+	if id := s.id.Load(); id == epochID && id != 0 {
+		return s.epoch
+	}
+	list := s.spill.Load()
+	if list == nil {
+		return nil
+	}
+	for _, e := range *list {
+		if e.id == epochID {
+			return e.epoch
+		}
+	}
+	return nil
 }
 
 type StateTree struct {
 	writerMu sync.Mutex
 
-	hasher *hash.Engine
+	hasher  hash.Hasher
+	hashKey [32]byte
+	radix16 bool
 
 	memory   MemoryManager
 	versions VersionControl
 	updater  BatchUpdater
+
+	compactor *compactor
+	wal       *wal
 }
 
 func NewStateTree(cfg Config) *StateTree {
+	if cfg.WALPath != "" {
+		panic("jmt: " + ErrWALPath.Error())
+	}
+	return newStateTree(cfg)
+}
+
+// newStateTree builds an empty tree and leaves cfg.WALPath to the caller.
+func newStateTree(cfg Config) *StateTree {
 	initial := cfg.InitialArenaCapacity
 	if initial < minInitialArenaCapacity {
 		initial = minInitialArenaCapacity
 	}
+	lanes := cfg.SIMDLanes
+	if lanes == 0 {
+		lanes = SIMDChunkSize
+	}
+	if !validSIMDLanes(lanes) {
+		panic("jmt: unsupported SIMD lane width")
+	}
+	radix16 := false
+	switch cfg.Radix {
+	case 0, 2:
+	case 16:
+		radix16 = true
+	default:
+		panic("jmt: unsupported radix")
+	}
 	retain := cfg.RetainVersions
 	if retain == 0 {
 		retain = defaultRetainVersions
 	}
 
-	engine := hash.NewEngine(cfg.HashKey)
-	initialEpoch := newEpochArena(1, initial)
+	engine := cfg.Hasher
+	if engine == nil {
+		var err error
+		engine, err = hash.New(cfg.HashScheme, cfg.HashKey)
+		if err != nil {
+			panic("jmt: " + err.Error())
+		}
+	}
+	store := cfg.NodeStore
+	if store == nil {
+		store = newArenaStore(max(initial, minEpochCapacity))
+	}
+	initialEpoch, err := store.NewEpoch(1, initial)
+	if err != nil {
+		panic("jmt: " + err.Error())
+	}
 	root := engine.ZeroHash(0)
 
-	return &StateTree{
-		hasher:   engine,
-		memory:   newMemoryManager(initial, retain, initialEpoch),
-		versions: newVersionControl(retain, initialEpoch, root),
-		updater:  newBatchUpdater(),
+	t := &StateTree{
+		hasher:  engine,
+		hashKey: cfg.HashKey,
+		radix16: radix16,
+		updater: newBatchUpdater(engine, lanes, resolveCommitWorkers(cfg.CommitWorkers), radix16),
+	}
+	// In place: latest points into snapshotRing, and both hold atomics.
+	t.memory.init(initial, retain, store, initialEpoch)
+	t.versions.init(retain, initialEpoch, root)
+	if cfg.CompactInterval > 0 {
+		budget := cfg.CompactBudget
+		if budget <= 0 {
+			budget = defaultCompactBudget
+		}
+		t.compactor = startCompactor(t, cfg.CompactInterval, budget, cfg.OnCompact)
 	}
+	return t
 }
 
 func (t *StateTree) LatestVersion() uint64 {
@@ -96,31 +289,56 @@ func (t *StateTree) HashStats() hash.Stats {
 }
 
 // ParentSIMDRatio returns the fraction of parent hash work that went through
-// the batched X4 path, derived from hash stats. Returns 0 if no parent work.
+// the batched path, derived from hash stats. Returns 0 if no parent work.
+// Batches only use a vector kernel where one exists (amd64 today).
 func (t *StateTree) ParentSIMDRatio() float64 {
 	return t.hasher.Stats().ParentSIMDRatio()
 }
 
-func (t *StateTree) Hasher() *hash.Engine {
+func (t *StateTree) Hasher() hash.Hasher {
 	return t.hasher
 }
 
-func (t *StateTree) Close() {
+// Close releases every epoch and closes the write-ahead log and the
+// NodeStore. It returns the first error from syncing or closing the log or
+// closing the store; closing an already closed tree does nothing.
+func (t *StateTree) Close() error {
+	// compactor는 writerMu를 잡으려 할 수 있으므로 잠그기 전에 멈춘다.
+	t.compactor.close()
 	t.writerMu.Lock()
 	defer t.writerMu.Unlock()
 
+	if t.memory.epochByID == nil {
+		return nil
+	}
+	t.updater.pool.close()
+	err := t.wal.close()
+	t.wal = nil
+	if t.updater.staged != nil {
+		t.updater.staged.done = true
+		t.updater.staged = nil
+	}
 	for _, epoch := range t.memory.epochs {
-		epoch.Free()
+		t.memory.store.ReleaseEpoch(epoch)
+	}
+	if closeErr := t.memory.store.Close(); err == nil {
+		err = closeErr
 	}
 	t.memory.epochs = nil
 	t.memory.epochByID = nil
 	t.memory.activeEpoch = nil
+	t.versions.rootsMu.Lock()
 	t.versions.versionRoots = nil
+	t.versions.rootsMu.Unlock()
 	t.versions.epochRefcount = nil
-	for i := range t.memory.warmPool {
-		t.memory.warmPool[i].Free()
-	}
-	t.memory.warmPool = nil
+	t.versions.epochFloor = nil
+	t.versions.retired = nil
+	t.versions.branches = nil
+	t.versions.pinned = nil
 	t.memory.locatorStore.Store(nil)
 	t.memory.nextLocator = 0
+	t.memory.locatorEnd = 0
+	t.memory.freeIndices = nil
+	t.memory.epochIndices = nil
+	return err
 }
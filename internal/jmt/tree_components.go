@@ -2,86 +2,152 @@
 
 package jmt
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Pam-La/jmt_for_mac/internal/hash"
+)
 
 type MemoryManager struct {
 	initialArenaCapacity int
 
-	epochs      []*EpochArena
-	epochByID   map[uint64]*EpochArena
-	activeEpoch *EpochArena
+	epochs      []EpochStore
+	epochByID   map[uint64]EpochStore
+	activeEpoch EpochStore
 	nextEpochID uint64
 
 	epochRing []epochRingSlot
 
-	warmPool    []*EpochArena
-	maxPoolSize int
+	store NodeStore
+	// blobScratch is the writer's buffer for reading blob records.
+	blobScratch []byte
 
+	// nextLocator hands out global node indices from a run ending at
+	// locatorEnd, which is maxNodeIndex on the never-used tail; locatorTail
+	// is where that tail starts while a recycled run is in use. See
+	// index_recycle.go.
 	nextLocator  uint32
+	locatorEnd   uint32
+	locatorTail  uint32
+	freeIndices  []indexRun
+	epochIndices []epochRuns
+	lastIndices  int
 	locatorStore atomic.Pointer[locatorStore]
 }
 
 type VersionControl struct {
 	retainVersions uint64
 
-	activeReaders atomic.Int64
-	latest        atomic.Pointer[Snapshot]
-	snapshotRing  [SnapshotRingSize]Snapshot
-
+	latest       atomic.Pointer[Snapshot]
+	snapshotRing [SnapshotRingSize]Snapshot
+	// latestSlot is the ring slot latest points to, or -1 for a heap
+	// snapshot. ringRetired holds the publishSeq at which each slot stopped
+	// being latest.
+	latestSlot  int
+	ringRetired [SnapshotRingSize]uint64
+
+	// publishSeq advances every time latest changes or something readers
+	// could reach is unlinked. Each open read transaction records the value
+	// it saw in a reader slot; anything unlinked at sequence s is reused only
+	// once every recorded value is >= s. Versions go backwards on Rollback
+	// and are reused by branches, so readers record the sequence rather than
+	// their version.
+	publishSeq atomic.Uint64
+	readers    [maxReaderSlots]readerSlot
+	overflow   readerSlot
+	readerHint atomic.Uint32
+
+	// rootsMu lets AcquireVersion read versionRoots without writerMu.
+	// Writers already hold writerMu and take it only to change the map.
+	rootsMu       sync.RWMutex
 	versionRoots  map[uint64]rootRef
 	epochRefcount map[uint64]int
+	// epochFloor is the oldest version committed into each epoch.
+	epochFloor map[uint64]uint64
+	// orphanEpochs have no versions left but may still hold nodes that
+	// retained trees share. The first orphansChecked of them were found live
+	// by the last mark walk; reclaimLocked walks again when more arrive and
+	// retires the unreachable ones at the current publishSeq.
+	orphanEpochs   []uint64
+	orphansChecked int
+	// compactAt is the number of pinned orphans at which reclaimLocked next
+	// runs a compaction pass.
+	compactAt   int
+	retired     []retiredEpoch
+	liveScratch []liveCandidate
+	liveNodes   []liveNode
+	markBits    []uint64
+
+	// branches are the named heads forked with Fork. pinned counts the
+	// branches forked from each version; pinned versions are neither
+	// reclaimed nor rolled back past.
+	branches map[string]*branch
+	pinned   map[uint64]int
 }
 
 type BatchUpdater struct {
-	dirtyQueue dirtyQueue
+	dirtyQueue  dirtyQueue
+	kvMutations []Mutation
+	// kvRaw and kvBytes hold the batch's own copies of KV keys and values.
+	kvRaw      []KVMutation
+	kvBytes    []byte
 	pathStacks []pathStack
-	levelBuf   levelBuffer
+	seeds      []leafSeed
+	builder    levelBuilder
+	// pool is nil unless Config.CommitWorkers asks for more than one core.
+	pool *commitPool
+	// staged is the batch written by Stage and not yet committed or discarded.
+	staged *StagedBatch
 }
 
-func newMemoryManager(initialArenaCapacity int, retainVersions uint64, initialEpoch *EpochArena) MemoryManager {
+func (m *MemoryManager) init(initialArenaCapacity int, retainVersions uint64, store NodeStore, initialEpoch EpochStore) {
 	ringSize := computeEpochRingSize(retainVersions)
 	ring := make([]epochRingSlot, ringSize)
-	slotIdx := initialEpoch.ID() % uint64(len(ring))
-	ring[slotIdx].arena.Store(initialEpoch)
-	ring[slotIdx].epochID.Store(initialEpoch.ID())
-
-	warmPool := make([]*EpochArena, 0, warmPoolMaxSize)
-	for i := 0; i < warmPoolBootstrapCount; i++ {
-		warmPool = append(warmPool, newEpochArena(0, initialArenaCapacity))
-	}
+	ring[initialEpoch.ID()%uint64(len(ring))].publish(initialEpoch)
 
 	dirSize := computeDefaultLocatorDirSize()
 	chunkSlots := make([]atomic.Pointer[locatorChunk], dirSize)
 	chunkSlots[0].Store(&locatorChunk{})
-	store := locatorStore{chunks: chunkSlots}
+	locators := locatorStore{chunks: chunkSlots}
 
-	m := MemoryManager{
+	*m = MemoryManager{
 		initialArenaCapacity: initialArenaCapacity,
-		epochs:               []*EpochArena{initialEpoch},
-		epochByID:            map[uint64]*EpochArena{initialEpoch.ID(): initialEpoch},
+		epochs:               []EpochStore{initialEpoch},
+		epochByID:            map[uint64]EpochStore{initialEpoch.ID(): initialEpoch},
 		activeEpoch:          initialEpoch,
 		nextEpochID:          2,
 		epochRing:            ring,
-		warmPool:             warmPool,
-		maxPoolSize:          warmPoolMaxSize,
+		store:                store,
 		nextLocator:          1,
+		locatorEnd:           maxNodeIndex,
 	}
-	m.locatorStore.Store(&store)
-	return m
+	m.locatorStore.Store(&locators)
 }
 
-func newVersionControl(retainVersions uint64, initialEpoch *EpochArena, root [32]byte) VersionControl {
-	vc := VersionControl{
+func (vc *VersionControl) init(retainVersions uint64, initialEpoch EpochStore, root [32]byte) {
+	*vc = VersionControl{
 		retainVersions: retainVersions,
 		versionRoots: map[uint64]rootRef{
 			0: {
 				epochID:   initialEpoch.ID(),
 				rootIndex: 0,
 				rootHash:  root,
+				head:      initialEpoch.Head(),
+				// MemoryManager.init starts handing out global indices at 1.
+				nextLocator: 1,
+				locatorEnd:  maxNodeIndex,
 			},
 		},
 		epochRefcount: map[uint64]int{initialEpoch.ID(): 1},
+		epochFloor:    map[uint64]uint64{initialEpoch.ID(): 0},
+		branches:      map[string]*branch{},
+		pinned:        map[uint64]int{},
+		latestSlot:    -1,
+		compactAt:     compactPinnedEpochs,
 	}
+	vc.publishSeq.Store(1)
+	vc.overflow.overflow = true
 	snap := &vc.snapshotRing[0]
 	*snap = Snapshot{
 		Version:   0,
@@ -90,9 +156,11 @@ func newVersionControl(retainVersions uint64, initialEpoch *EpochArena, root [32
 		RootHash:  root,
 	}
 	vc.latest.Store(snap)
-	return vc
 }
 
-func newBatchUpdater() BatchUpdater {
-	return BatchUpdater{}
+func newBatchUpdater(hasher hash.Hasher, lanes int, workers int, radix16 bool) BatchUpdater {
+	return BatchUpdater{
+		builder: levelBuilder{router: newSIMDRouter(hasher, lanes)},
+		pool:    newCommitPool(hasher, lanes, workers, radix16),
+	}
 }
@@ -2,31 +2,57 @@
 
 package jmt
 
-import "github.com/Pam-La/jmt_for_mac/internal/proof"
+import (
+	"bytes"
+
+	"github.com/Pam-La/jmt_for_mac/internal/proof"
+)
 
 type ReadTxn struct {
 	tree     *StateTree
 	snapshot *Snapshot
+	slot     *readerSlot
 }
 
 func (t *StateTree) AcquireLatest() ReadTxn {
-	t.versions.activeReaders.Add(1)
+	slot := t.enterReader()
 	snap := t.versions.latest.Load()
 	if snap == nil {
-		t.versions.activeReaders.Add(-1)
+		slot.leave()
 		return ReadTxn{}
 	}
+	slot.observe(snap.Version)
 	return ReadTxn{
 		tree:     t,
 		snapshot: snap,
+		slot:     slot,
+	}
+}
+
+// AcquireVersion opens a read transaction at a retained version. The
+// version's epochs are not reclaimed while the transaction is open. It does
+// not wait for the writer.
+func (t *StateTree) AcquireVersion(version uint64) (ReadTxn, error) {
+	// slot을 먼저 잡는다. 그 뒤에 map에서 찾은 버전은 이 reader가 들어온 뒤에야
+	// 지워지므로, writer는 그 버전을 버린 seq에서 이 reader를 보게 된다.
+	slot := t.enterReader()
+	t.versions.rootsMu.RLock()
+	ref, ok := t.versions.versionRoots[version]
+	t.versions.rootsMu.RUnlock()
+	if !ok {
+		slot.leave()
+		return ReadTxn{}, ErrUnknownVersion
 	}
+	slot.observe(version)
+	snapshot := ref.snapshot(version)
+	return ReadTxn{tree: t, snapshot: &snapshot, slot: slot}, nil
 }
 
 func (r ReadTxn) Release() {
-	if r.tree == nil {
+	if r.slot == nil {
 		return
 	}
-	r.tree.versions.activeReaders.Add(-1)
+	r.slot.leave()
 }
 
 func (r ReadTxn) Snapshot() Snapshot {
@@ -43,25 +69,37 @@ func (r ReadTxn) RootHash() [32]byte {
 	return r.snapshot.RootHash
 }
 
+// GenerateProof proves key at the transaction's snapshot. It returns an
+// empty proof once the node store has failed a read; see StateTree.Err.
 func (r ReadTxn) GenerateProof(key [32]byte) proof.MerkleProof {
 	if r.snapshot == nil {
 		return proof.MerkleProof{}
 	}
+	p := r.generateProof(key)
+	if r.tree.memory.store.Err() != nil {
+		return proof.MerkleProof{}
+	}
+	return p
+}
 
+func (r ReadTxn) generateProof(key [32]byte) proof.MerkleProof {
 	var merkleProof proof.MerkleProof
 	merkleProof.Version = r.snapshot.Version
+	merkleProof.LeafKey = key
 
 	current := r.snapshot.RootIndex
-	for depth := 0; depth < proof.TreeDepth; depth++ {
-		if current == 0 {
-			merkleProof.Siblings[depth] = r.tree.hasher.ZeroHash(uint16(depth + 1))
-			continue
-		}
-
+	depth := 0
+	for current != 0 && depth < proof.TreeDepth {
 		node, _, ok := r.tree.nodeByIndex(current)
 		if !ok {
-			merkleProof.Siblings[depth] = r.tree.hasher.ZeroHash(uint16(depth + 1))
 			current = 0
+			break
+		}
+		if isLeaf(node.Prefix) {
+			break
+		}
+		if isRadix16(node.Prefix) {
+			current, depth = r.tree.proofThrough16(&merkleProof, asNode16(&node), key, depth)
 			continue
 		}
 
@@ -73,21 +111,107 @@ func (r ReadTxn) GenerateProof(key [32]byte) proof.MerkleProof {
 			merkleProof.Siblings[depth] = r.tree.nodeHashAtDepth(node.LeftIndex, uint16(depth+1))
 			current = node.RightIndex
 		}
+		depth++
 	}
+	merkleProof.Depth = uint16(depth)
 
 	if current != 0 {
 		leaf, _, ok := r.tree.nodeByIndex(current)
-		if ok && isLeaf(leaf.Prefix) && decodeDepth(leaf.Prefix) == uint16(JMTTreeDepth) {
-			merkleProof.Exists = true
+		if ok && isLeaf(leaf.Prefix) {
+			// 경로 끝의 leaf가 다른 key면 그 leaf 자체가 non-membership 증거다.
+			merkleProof.Exists = leaf.Key == key
+			merkleProof.LeafKey = leaf.Key
 			merkleProof.LeafHash = leaf.Hash
+			merkleProof.Value = leaf.Value
 			return merkleProof
 		}
 	}
 	merkleProof.Exists = false
-	merkleProof.LeafHash = r.tree.hasher.ZeroHash(JMTTreeDepth)
+	merkleProof.LeafHash = r.tree.hasher.ZeroHash(merkleProof.Depth)
 	return merkleProof
 }
 
+// Get returns the value stored under key at the transaction's snapshot.
+func (r ReadTxn) Get(key [32]byte) ([32]byte, bool) {
+	if r.snapshot == nil {
+		return [32]byte{}, false
+	}
+	leaf, _, ok := r.tree.lookupLeaf(r.snapshot.RootIndex, key)
+	if !ok {
+		return [32]byte{}, false
+	}
+	return leaf.Value, true
+}
+
+// GetBytes appends the value stored under a variable-length key to dst.
+func (r ReadTxn) GetBytes(dst []byte, key []byte) ([]byte, bool) {
+	if r.snapshot == nil {
+		return dst, false
+	}
+	leaf, epoch, ok := r.tree.lookupLeaf(r.snapshot.RootIndex, r.tree.hasher.HashKey(key))
+	if !ok {
+		return dst, false
+	}
+	// file store는 dst의 남는 용량에 레코드를 읽고, append가 value를 앞으로 당긴다.
+	spare := dst[len(dst):]
+	storedKey, value, ok := epoch.Blob(leaf.Blob, &spare)
+	if !ok || !bytes.Equal(storedKey, key) {
+		return dst, false
+	}
+	return append(dst, value...), true
+}
+
+// GenerateProofBytes proves a variable-length key. The proof carries the
+// original key so verifiers can recompute the path; MerkleProof.Value is
+// the committed value hash.
+func (r ReadTxn) GenerateProofBytes(key []byte) proof.MerkleProof {
+	if r.snapshot == nil {
+		return proof.MerkleProof{}
+	}
+	p := r.GenerateProof(r.tree.hasher.HashKey(key))
+	p.Key = key
+	return p
+}
+
+// lookupLeaf follows key's path from rootIndex down to the first leaf and
+// reports it only if it holds key.
+func (t *StateTree) lookupLeaf(rootIndex uint32, key [32]byte) (Node, EpochStore, bool) {
+	current := rootIndex
+	for depth := 0; current != 0 && depth <= JMTTreeDepth; {
+		node, epoch, ok := t.nodeByIndex(current)
+		if !ok {
+			return Node{}, nil, false
+		}
+		if isLeaf(node.Prefix) {
+			if node.Key != key {
+				return Node{}, nil, false
+			}
+			return node, epoch, true
+		}
+		if depth == JMTTreeDepth {
+			break
+		}
+		if isRadix16(node.Prefix) {
+			current = asNode16(&node).Children[nibbleAt(key, depth/4)]
+			depth += 4
+			continue
+		}
+		if bitAt(key, uint16(depth)) == 0 {
+			current = node.LeftIndex
+		} else {
+			current = node.RightIndex
+		}
+		depth++
+	}
+	return Node{}, nil, false
+}
+
+// Err returns the first read error of the node store, after which commits
+// fail with it and proofs come back empty.
+func (t *StateTree) Err() error {
+	return t.memory.store.Err()
+}
+
 func (t *StateTree) RootHash() [32]byte {
 	snap := t.versions.latest.Load()
 	if snap == nil {
@@ -2,23 +2,110 @@
 
 package jmt
 
+import (
+	"bytes"
+	"errors"
+)
+
 type Mutation struct {
 	Key    [32]byte
 	Value  [32]byte
 	Delete bool
+	// Require is checked against the base version; if any mutation's
+	// precondition fails the batch is rejected with a *PreconditionError.
+	Require          Precondition
+	ExpectedLeafHash [32]byte
+
+	raw  *KVMutation
+	blob BlobRef
+}
+
+// KVMutation sets or deletes a variable-length key. The tree path is
+// Hasher.HashKey(Key) and the leaf commits to Hasher.HashValue(Value); the
+// original bytes are stored out of line in the commit's epoch.
+type KVMutation struct {
+	Key              []byte
+	Value            []byte
+	Delete           bool
+	Require          Precondition
+	ExpectedLeafHash [32]byte
 }
 
+// pendingParent는 router에 대기 중인 부모 노드의 자식 인덱스와 next level 내 위치다.
 type pendingParent struct {
 	leftIndex  uint32
 	rightIndex uint32
-	key        [32]byte
-	witness    uint32
+	slot       uint32
 }
 
 func (t *StateTree) ApplyBatch(mutations []Mutation) (Snapshot, error) {
 	t.writerMu.Lock()
 	defer t.writerMu.Unlock()
+	return t.applyBatchLocked(mutations)
+}
+
+// ApplyKVBatch commits a batch of variable-length mutations. Keys and values
+// are copied before anything is hashed, so the caller may reuse them as soon
+// as it returns.
+func (t *StateTree) ApplyKVBatch(mutations []KVMutation) (Snapshot, error) {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
 
+	raws := t.updater.copyKVMutations(mutations)
+	converted := t.updater.kvMutations[:0]
+	for i := range raws {
+		m := &raws[i]
+		mutation := Mutation{
+			Key:              t.hasher.HashKey(m.Key),
+			Delete:           m.Delete,
+			Require:          m.Require,
+			ExpectedLeafHash: m.ExpectedLeafHash,
+			raw:              m,
+		}
+		if !m.Delete {
+			mutation.Value = t.hasher.HashValue(m.Value)
+		}
+		converted = append(converted, mutation)
+	}
+	t.updater.kvMutations = converted
+	return t.applyBatchLocked(converted)
+}
+
+// copyKVMutations copies mutations and their bytes into the updater's reused
+// buffers. Mutation.raw points into them until the next KV batch, so neither
+// the blob heap nor the WAL record reads memory the caller still owns.
+func (u *BatchUpdater) copyKVMutations(mutations []KVMutation) []KVMutation {
+	size := 0
+	for i := range mutations {
+		size += len(mutations[i].Key) + len(mutations[i].Value)
+	}
+	if cap(u.kvBytes) < size {
+		u.kvBytes = make([]byte, 0, size)
+	}
+	buf := u.kvBytes[:0]
+	raws := append(u.kvRaw[:0], mutations...)
+	for i := range raws {
+		m := &raws[i]
+		start := len(buf)
+		buf = append(buf, m.Key...)
+		m.Key = buf[start:len(buf):len(buf)]
+		if m.Delete {
+			m.Value = nil
+			continue
+		}
+		start = len(buf)
+		buf = append(buf, m.Value...)
+		m.Value = buf[start:len(buf):len(buf)]
+	}
+	u.kvBytes = buf
+	u.kvRaw = raws
+	return raws
+}
+
+func (t *StateTree) applyBatchLocked(mutations []Mutation) (Snapshot, error) {
+	if t.updater.staged != nil {
+		return Snapshot{}, ErrStagePending
+	}
 	current := t.versions.latest.Load()
 	if current == nil {
 		return Snapshot{}, ErrUnknownVersion
@@ -26,6 +113,9 @@ func (t *StateTree) ApplyBatch(mutations []Mutation) (Snapshot, error) {
 	if len(mutations) == 0 {
 		return *current, nil
 	}
+	if err := t.checkPreconditions(current.RootIndex, mutations); err != nil {
+		return Snapshot{}, err
+	}
 
 	normalized := t.updater.dirtyQueue.normalize(mutations)
 	if len(normalized) == 0 {
@@ -33,92 +123,239 @@ func (t *StateTree) ApplyBatch(mutations []Mutation) (Snapshot, error) {
 	}
 
 	nextVersion := current.Version + 1
-	requiredNodes := estimateRequiredNodes(len(normalized))
+	ref, undo, err := t.commitLocked(current.RootIndex, normalized, nextVersion, &t.memory.activeEpoch)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := t.logBatchLocked(nextVersion, ref.rootHash, normalized); err != nil {
+		undo.undo(t)
+		return Snapshot{}, err
+	}
+	return t.publishLocked(nextVersion, ref), nil
+}
 
-	var epoch *EpochArena
-	prevActive := t.memory.activeEpoch
-	createdEpoch := false
-	if t.memory.activeEpoch != nil && t.memory.activeEpoch.Remaining() >= requiredNodes {
-		epoch = t.memory.activeEpoch
+// publishLocked makes ref the latest version.
+func (t *StateTree) publishLocked(version uint64, ref rootRef) Snapshot {
+	snapshot := t.writableSnapshotSlot(version)
+	*snapshot = ref.snapshot(version)
+
+	t.storeLatestLocked(snapshot)
+	t.versions.rootsMu.Lock()
+	t.versions.versionRoots[version] = ref
+	t.versions.rootsMu.Unlock()
+	t.countVersionLocked(ref.epochID, version)
+	t.reclaimLocked()
+
+	return *snapshot
+}
+
+// commitLocked writes a normalized batch on top of baseRoot into *active,
+// which is the main head's epoch or a branch's. The caller publishes the
+// returned version and counts it in epochRefcount, or undoes it.
+func (t *StateTree) commitLocked(baseRoot uint32, mutations []Mutation, version uint64, active *EpochStore) (rootRef, batchUndo, error) {
+	undo, rootIndex, rootHash, err := t.writeBatchLocked(baseRoot, mutations, version, active, batchNodeEstimatePerMutation)
+	if errors.Is(err, ErrArenaFull) {
+		// 공유 prefix가 긴 key들은 추정보다 깊이 내려간다. 되돌린 뒤 최악의 경우로 다시 쓴다.
+		undo, rootIndex, rootHash, err = t.writeBatchLocked(baseRoot, mutations, version, active, batchNodeWorstPerMutation)
+	}
+	if err != nil {
+		return rootRef{}, batchUndo{}, err
+	}
+	if err := t.memory.store.Err(); err != nil {
+		// 읽지 못한 노드를 빈 자리로 보고 만든 트리다.
+		undo.undo(t)
+		return rootRef{}, batchUndo{}, err
+	}
+	epoch := undo.epoch
+	t.recordIndicesLocked(epoch.ID(), undo.locator, t.memory.nextLocator)
+	return rootRef{
+		epochID:     epoch.ID(),
+		rootIndex:   rootIndex,
+		rootHash:    rootHash,
+		head:        epoch.Head(),
+		blobs:       epoch.BlobMark(),
+		nextLocator: t.memory.nextLocator,
+		locatorEnd:  t.memory.locatorEnd,
+	}, undo, nil
+}
+
+// batchUndo records where a batch started writing so that everything it
+// wrote can be handed back.
+type batchUndo struct {
+	active     *EpochStore
+	prevActive EpochStore
+	epoch      EpochStore
+	created    bool
+	head       uint32
+	blobs      BlobMark
+	locator    uint32
+}
+
+// undo truncates the batch's epoch back to where the batch started, or
+// discards it if the batch created it, and rewinds the global locator.
+func (u *batchUndo) undo(t *StateTree) {
+	t.rewindLocatorLocked(u.locator)
+	if u.created {
+		t.discardEpoch(u.epoch)
+		*u.active = u.prevActive
+		return
+	}
+	u.epoch.Truncate(u.head)
+	u.epoch.TruncateBlobs(u.blobs)
+}
+
+// beginBatchLocked picks *active, or a new epoch when it cannot hold
+// requiredNodes, and reserves locator space for them. The returned undo
+// hands back everything the batch writes after this point.
+func (t *StateTree) beginBatchLocked(active *EpochStore, requiredNodes int) (batchUndo, error) {
+	undo := batchUndo{active: active, prevActive: *active}
+	if *active != nil && remaining(*active) >= requiredNodes {
+		undo.epoch = *active
 	} else {
-		allocCapacity := maxInt(requiredNodes, t.memory.initialArenaCapacity)
-		var err error
-		epoch, err = t.acquireEpoch(allocCapacity)
+		// 새 epoch은 slot 0을 비워 두므로 하나 더 잡는다.
+		allocCapacity := maxInt(requiredNodes+1, t.memory.initialArenaCapacity)
+		epoch, err := t.acquireEpoch(allocCapacity)
 		if err != nil {
-			return Snapshot{}, err
+			return batchUndo{}, err
 		}
-		t.memory.activeEpoch = epoch
-		createdEpoch = true
+		*active = epoch
+		undo.epoch = epoch
+		undo.created = true
 	}
 
-	headBase := epoch.Head()
-	locatorBase := t.memory.nextLocator
-
+	undo.head = undo.epoch.Head()
+	undo.blobs = undo.epoch.BlobMark()
+	// 예약이 다른 run으로 옮길 수 있으므로 locator는 예약한 뒤에 기록한다.
 	if err := t.reserveLocatorSpace(uint32(requiredNodes)); err != nil {
-		if createdEpoch {
-			t.discardEpoch(epoch)
-			t.memory.activeEpoch = prevActive
-		}
-		return Snapshot{}, err
+		undo.locator = t.memory.nextLocator
+		undo.undo(t)
+		return batchUndo{}, err
 	}
+	undo.locator = t.memory.nextLocator
+	return undo, nil
+}
 
-	rootIndex, rootHash, err := t.updater.applyDirtyPaths(t, current.RootIndex, epoch, nextVersion, normalized)
+// writeBatchLocked stores the batch's blobs and nodes in an epoch sized for
+// perMutation nodes per mutation. On failure everything it wrote is undone.
+func (t *StateTree) writeBatchLocked(baseRoot uint32, mutations []Mutation, version uint64, active *EpochStore, perMutation int) (batchUndo, uint32, [32]byte, error) {
+	requiredNodes := estimateRequiredNodes(len(mutations), perMutation)
+	undo, err := t.beginBatchLocked(active, requiredNodes)
 	if err != nil {
-		t.memory.nextLocator = locatorBase
-		if createdEpoch {
-			t.discardEpoch(epoch)
-			t.memory.activeEpoch = prevActive
-		} else {
-			epoch.Truncate(headBase)
-		}
-		return Snapshot{}, err
-	}
-	snapshot := t.writableSnapshotSlot(nextVersion)
-	*snapshot = Snapshot{
-		Version:   nextVersion,
-		EpochID:   epoch.ID(),
-		RootIndex: rootIndex,
-		RootHash:  rootHash,
+		return batchUndo{}, 0, [32]byte{}, err
 	}
 
-	t.versions.latest.Store(snapshot)
-	t.versions.versionRoots[nextVersion] = rootRef{
-		epochID:   epoch.ID(),
-		rootIndex: rootIndex,
-		rootHash:  rootHash,
+	epoch := undo.epoch
+	err = storeBlobs(epoch, mutations)
+	var (
+		rootIndex uint32
+		rootHash  [32]byte
+	)
+	if err == nil {
+		rootIndex, rootHash, err = t.updater.applyDirtyPaths(t, baseRoot, epoch, version, mutations, perMutation)
 	}
-	t.versions.epochRefcount[epoch.ID()]++
-	t.reclaimLocked()
-
-	return *snapshot, nil
+	if err != nil {
+		undo.undo(t)
+		return batchUndo{}, 0, [32]byte{}, err
+	}
+	return undo, rootIndex, rootHash, nil
 }
 
+// Rollback makes version the latest again and discards every newer version.
+// Epochs left without versions are recycled and, when no reader can still
+// see the discarded versions, the space they used in version's epoch and
+// their global node indices are handed back to the next commit.
 func (t *StateTree) Rollback(version uint64) (Snapshot, error) {
 	t.writerMu.Lock()
 	defer t.writerMu.Unlock()
 
+	if t.updater.staged != nil {
+		return Snapshot{}, ErrStagePending
+	}
 	ref, ok := t.versions.versionRoots[version]
 	if !ok {
 		return Snapshot{}, ErrUnknownVersion
 	}
-	if _, ok := t.memory.epochByID[ref.epochID]; !ok {
+	epoch, ok := t.memory.epochByID[ref.epochID]
+	if !ok {
 		return Snapshot{}, ErrUnknownVersion
 	}
-	snapshot := t.writableSnapshotSlot(version)
-	*snapshot = Snapshot{
-		Version:   version,
-		EpochID:   ref.epochID,
-		RootIndex: ref.rootIndex,
-		RootHash:  ref.rootHash,
+	if t.pinnedAfterLocked(version) {
+		return Snapshot{}, ErrVersionPinned
+	}
+	if t.wal != nil && version < t.wal.base {
+		return Snapshot{}, ErrWALBase
+	}
+	if err := t.logRollbackLocked(version, ref.rootHash); err != nil {
+		return Snapshot{}, err
 	}
-	t.versions.latest.Store(snapshot)
+	snapshot := t.writableSnapshotSlot(version)
+	*snapshot = ref.snapshot(version)
+	// 새 reader가 버려질 버전을 잡지 않도록 latest를 먼저 게시한 뒤 reader 수를 본다.
+	t.storeLatestLocked(snapshot)
+	t.truncateAfterLocked(version, ref, epoch)
 	t.reclaimLocked()
 
 	return *snapshot, nil
 }
 
-func estimateRequiredNodes(mutations int) int {
-	estimated := (mutations * batchNodeEstimatePerMutation) + batchNodeEstimateBase
+// truncateAfterLocked drops the versions newer than version, whose nodes were
+// all written after ref was committed. Caller must hold writerMu.
+func (t *StateTree) truncateAfterLocked(version uint64, ref rootRef, epoch EpochStore) {
+	dropped := false
+	t.versions.rootsMu.Lock()
+	for v, newer := range t.versions.versionRoots {
+		if v <= version {
+			continue
+		}
+		dropped = true
+		delete(t.versions.versionRoots, v)
+		if cnt, ok := t.versions.epochRefcount[newer.epochID]; ok {
+			cnt--
+			t.versions.epochRefcount[newer.epochID] = cnt
+			if cnt == 0 {
+				t.versions.orphanEpochs = append(t.versions.orphanEpochs, newer.epochID)
+			}
+		}
+	}
+	t.versions.rootsMu.Unlock()
+	if !dropped {
+		return
+	}
+
+	t.memory.activeEpoch = epoch
+	// latest도 versionRoots도 버려진 버전을 더 이상 가리키지 않으므로 seq를 올리면,
+	// 그보다 먼저 들어와 version보다 새 버전을 보는 reader만 버려진 노드를 볼 수 있다.
+	if t.readerBlocksLocked(t.versions.publishSeq.Add(1), version+1) {
+		return
+	}
+	epoch.Truncate(ref.head)
+	epoch.TruncateBlobs(ref.blobs)
+	// branch 노드는 ref 이후의 global index를 쓰고 있을 수 있다. 그 사이 다른 run으로
+	// 옮겼다면 버려진 index는 epoch이 회수될 때 돌아온다.
+	if len(t.versions.branches) == 0 && ref.locatorEnd == t.memory.locatorEnd && ref.nextLocator <= t.memory.nextLocator {
+		t.rewindLocatorLocked(ref.nextLocator)
+	}
+}
+
+// storeBlobs copies the original bytes of KV mutations into the epoch's blob
+// heap before the leaves that reference them are built.
+func storeBlobs(epoch EpochStore, mutations []Mutation) error {
+	for i := range mutations {
+		m := &mutations[i]
+		if m.raw == nil || m.Delete {
+			continue
+		}
+		ref, err := epoch.AppendBlob(m.raw.Key, m.raw.Value)
+		if err != nil {
+			return err
+		}
+		m.blob = ref
+	}
+	return nil
+}
+
+func estimateRequiredNodes(mutations int, perMutation int) int {
+	estimated := (mutations * perMutation) + batchNodeEstimateBase
 	if estimated > int(maxNodeIndex)-1 {
 		estimated = int(maxNodeIndex) - 1
 	}
@@ -135,7 +372,7 @@ func maxInt(a, b int) int {
 	return b
 }
 
-func (u *BatchUpdater) applyDirtyPaths(t *StateTree, baseRoot uint32, epoch *EpochArena, version uint64, mutations []Mutation) (uint32, [32]byte, error) {
+func (u *BatchUpdater) applyDirtyPaths(t *StateTree, baseRoot uint32, epoch EpochStore, version uint64, mutations []Mutation, perMutation int) (uint32, [32]byte, error) {
 	if len(mutations) == 0 {
 		return baseRoot, t.nodeHashAtDepth(baseRoot, 0), nil
 	}
@@ -145,154 +382,76 @@ func (u *BatchUpdater) applyDirtyPaths(t *StateTree, baseRoot uint32, epoch *Epo
 	}
 	stacks := u.pathStacks[:len(mutations)]
 
-	u.levelBuf.ensure(len(mutations))
-	u.levelBuf.reset()
-	curr := u.levelBuf.curr
-
-	for i := range mutations {
-		mutation := mutations[i]
-		u.fillPathStack(t, baseRoot, mutation.Key, &stacks[i])
-
-		leafIndex := uint32(0)
-		if !mutation.Delete {
-			leafHash := t.hasher.HashLeaf(&mutation.Key, &mutation.Value)
-			leafNode := Node{
-				Hash:    leafHash,
-				Version: version,
-				Prefix:  makePrefix(JMTTreeDepth, true),
-			}
-			var err error
-			leafIndex, err = t.allocNode(epoch, leafNode)
-			if err != nil {
-				return 0, [32]byte{}, err
-			}
+	parallel := u.pool != nil && len(mutations) >= parallelCommitMinMutations
+	if parallel {
+		u.pool.fill(t, baseRoot, mutations, stacks)
+	} else {
+		for i := range mutations {
+			fillPathStack(t, baseRoot, mutations[i].Key, &stacks[i])
 		}
-
-		curr = append(curr, levelEntry{
-			key:     mutation.Key,
-			index:   leafIndex,
-			witness: uint32(i),
-		})
 	}
+	seeds := u.buildSeeds(mutations, stacks)
 
-	u.levelBuf.curr = curr
-
-	router := newSIMDRouter(t.hasher)
-	for depth := JMTTreeDepth - 1; depth >= 0; depth-- {
-		next := u.levelBuf.next[:0]
-		router.Reset()
-
-		i := 0
-		for i < len(u.levelBuf.curr) {
-			groupStart := i
-			i++
-			for i < len(u.levelBuf.curr) && samePrefix(u.levelBuf.curr[groupStart].key, u.levelBuf.curr[i].key, uint16(depth)) {
-				i++
-			}
-
-			var (
-				hasLeft, hasRight     bool
-				leftIndex, rightIndex uint32
-				leftWitness, rightWit uint32
-			)
-
-			for j := groupStart; j < i; j++ {
-				entry := u.levelBuf.curr[j]
-				if bitAt(entry.key, uint16(depth)) == 0 {
-					hasLeft = true
-					leftIndex = entry.index
-					leftWitness = entry.witness
-				} else {
-					hasRight = true
-					rightIndex = entry.index
-					rightWit = entry.witness
-				}
-			}
+	if parallel {
+		return u.pool.apply(t, &u.builder, epoch, version, seeds, mutations, stacks, perMutation)
+	}
 
-			witness := leftWitness
-			if !hasLeft {
-				witness = rightWit
-				leftIndex = stacks[rightWit].sibling[depth]
-			}
-			if !hasRight {
-				rightIndex = stacks[leftWitness].sibling[depth]
-			}
+	// ApplyBatch가 requiredNodes만큼 locator를 예약했고, 새 epoch은 head 0 슬롯 때문에 하나 모자랄 수 있다.
+	size := min(estimateRequiredNodes(len(mutations), perMutation), remaining(epoch))
+	region, err := t.carveRegion(epoch, uint32(size))
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+	b := &u.builder
+	if err := b.loadLeaves(t, &region, seeds, mutations, version); err != nil {
+		return 0, [32]byte{}, err
+	}
+	if err := b.mergeDepths(t, &region, stacks, version, JMTTreeDepth-1, 0); err != nil {
+		return 0, [32]byte{}, err
+	}
+	t.trimRegion(&region)
 
-			parentKey := prefixPath(u.levelBuf.curr[groupStart].key, uint16(depth))
-			if leftIndex == 0 && rightIndex == 0 {
-				next = append(next, levelEntry{
-					key:     parentKey,
-					index:   0,
-					witness: witness,
-				})
-				continue
-			}
+	rootIndex, rootHash := b.root(t)
+	return rootIndex, rootHash, nil
+}
 
-			meta := pendingParent{
-				leftIndex:  leftIndex,
-				rightIndex: rightIndex,
-				key:        parentKey,
-				witness:    witness,
-			}
-			full := router.Add(
-				t.nodeHashAtDepth(leftIndex, uint16(depth+1)),
-				t.nodeHashAtDepth(rightIndex, uint16(depth+1)),
-				meta,
-			)
-			if full {
-				hashes, metas := router.FlushX4()
-				for k := 0; k < SIMDChunkSize; k++ {
-					parentNode := Node{
-						Hash:       hashes[k],
-						Version:    version,
-						Prefix:     makePrefix(uint16(depth), false),
-						LeftIndex:  metas[k].leftIndex,
-						RightIndex: metas[k].rightIndex,
-					}
-					parentIndex, err := t.allocNode(epoch, parentNode)
-					if err != nil {
-						return 0, [32]byte{}, err
-					}
-					next = append(next, levelEntry{
-						key:     metas[k].key,
-						index:   parentIndex,
-						witness: metas[k].witness,
-					})
-				}
-			}
+// buildSeeds lists the batch's bottom entries in key order. When mutations
+// land on an existing leaf with another key, that leaf must be pushed down
+// next to them, so it is added as a displaced seed.
+func (u *BatchUpdater) buildSeeds(mutations []Mutation, stacks []pathStack) []leafSeed {
+	seeds := u.seeds[:0]
+	for lo := 0; lo < len(mutations); {
+		hi := lo + 1
+		leaf := stacks[lo].leaf
+		if leaf == 0 {
+			seeds = append(seeds, leafSeed{key: mutations[lo].Key, witness: uint32(lo)})
+			lo = hi
+			continue
 		}
-
-		for j := 0; j < router.count; j++ {
-			pair := router.batch[j]
-			meta := router.meta[j]
-			parentHash := t.hasher.HashParent(&pair.Left, &pair.Right)
-			parentNode := Node{
-				Hash:       parentHash,
-				Version:    version,
-				Prefix:     makePrefix(uint16(depth), false),
-				LeftIndex:  meta.leftIndex,
-				RightIndex: meta.rightIndex,
+		// 같은 leaf에 닿은 mutation은 그 leaf의 prefix를 공유하므로 정렬 순서상 연속이다.
+		for hi < len(mutations) && stacks[hi].leaf == leaf {
+			hi++
+		}
+		leafKey := stacks[lo].leafKey
+		displaced := true
+		for i := lo; i < hi; i++ {
+			if mutations[i].Key == leafKey {
+				displaced = false
+				break
 			}
-			parentIndex, err := t.allocNode(epoch, parentNode)
-			if err != nil {
-				return 0, [32]byte{}, err
+		}
+		for i := lo; i < hi; i++ {
+			if displaced && bytes.Compare(leafKey[:], mutations[i].Key[:]) < 0 {
+				seeds = append(seeds, leafSeed{key: leafKey, leaf: leaf, witness: uint32(i)})
+				displaced = false
 			}
-			next = append(next, levelEntry{
-				key:     meta.key,
-				index:   parentIndex,
-				witness: meta.witness,
-			})
+			seeds = append(seeds, leafSeed{key: mutations[i].Key, witness: uint32(i)})
 		}
-		router.Reset()
-
-		u.levelBuf.next = next
-		u.levelBuf.swap()
-	}
-
-	if len(u.levelBuf.curr) == 0 {
-		return 0, t.hasher.ZeroHash(0), nil
+		if displaced {
+			seeds = append(seeds, leafSeed{key: leafKey, leaf: leaf, witness: uint32(hi - 1)})
+		}
+		lo = hi
 	}
-	rootIndex := u.levelBuf.curr[0].index
-	rootHash := t.nodeHashAtDepth(rootIndex, 0)
-	return rootIndex, rootHash, nil
+	u.seeds = seeds
+	return seeds
 }
@@ -2,45 +2,190 @@
 
 package jmt
 
-// writableSnapshotSlot returns a reusable ring slot when there are no active
-// readers. If readers are active, it falls back to heap allocation so published
-// snapshots are never overwritten while a read transaction can still observe
-// them.
+import (
+	"sync/atomic"
+	"time"
+)
+
+// readerSlot describes one open read transaction: the publishSeq it
+// entered at and the version it observes, stored as version+1 and 0 until
+// it is known. A free slot has seq 0. Slots sit on separate cache lines so
+// readers on different cores do not contend.
+//
+// The overflow slot is shared by the readers that find every slot taken.
+// It counts them in sharers and keeps the oldest seq any of them entered
+// at; it never records a version, so writers treat it conservatively.
+type readerSlot struct {
+	seq      atomic.Uint64
+	observed atomic.Uint64
+	sharers  atomic.Int64
+	overflow bool
+	_        [CacheLineSize - 32]byte
+}
+
+// retiredEpoch is an epoch left without versions at publishSeq seq. floor
+// is the oldest version committed into it; a reader observing an older
+// version cannot reach its nodes.
+type retiredEpoch struct {
+	epochID uint64
+	seq     uint64
+	floor   uint64
+}
+
+// enterReader claims a free reader slot at the current publishSeq, or
+// joins the overflow slot when all of them are taken; it never waits. The
+// caller loads its snapshot only after this returns and then records the
+// version with observe: a writer that did not see the slot had already
+// unlinked everything the reader must not reach.
+func (t *StateTree) enterReader() *readerSlot {
+	readers := &t.versions.readers
+	seq := t.versions.publishSeq.Load()
+	start := t.versions.readerHint.Add(1)
+	for i := uint32(0); i < maxReaderSlots; i++ {
+		slot := &readers[(start+i)%maxReaderSlots]
+		if slot.seq.Load() == 0 && slot.seq.CompareAndSwap(0, seq) {
+			return slot
+		}
+	}
+	overflow := &t.versions.overflow
+	overflow.sharers.Add(1)
+	// 이미 다른 reader가 seq를 남겼다면 그쪽이 더 오래되었으므로 그대로 둔다.
+	overflow.seq.CompareAndSwap(0, seq)
+	return overflow
+}
+
+//go:inline
+func (s *readerSlot) observe(version uint64) {
+	if s.overflow {
+		return
+	}
+	s.observed.Store(version + 1)
+}
+
+//go:inline
+func (s *readerSlot) leave() {
+	if s.overflow {
+		if s.sharers.Add(-1) == 0 {
+			s.seq.Store(0)
+		}
+		return
+	}
+	s.observed.Store(0)
+	s.seq.Store(0)
+}
+
+// readerBlocksLocked reports whether a reader that entered before seq and
+// observes a version >= floor, or one not yet known, is still open.
+func (t *StateTree) readerBlocksLocked(seq, floor uint64) bool {
+	if overflow := &t.versions.overflow; overflow.sharers.Load() > 0 {
+		// seq 0은 아직 기록 전이거나 마지막 reader가 나가며 지운 값이다. 어느 쪽이든 막는다.
+		if entered := overflow.seq.Load(); entered == 0 || entered < seq {
+			return true
+		}
+	}
+	for i := range t.versions.readers {
+		r := &t.versions.readers[i]
+		entered := r.seq.Load()
+		if entered == 0 || entered >= seq {
+			continue
+		}
+		observed := r.observed.Load()
+		if r.seq.Load() != entered {
+			// 읽는 사이 slot 주인이 바뀌었다. 새 reader는 seq 이후에 들어왔으니 옛 주인만 보수적으로 본다.
+			observed = 0
+		}
+		if observed == 0 || observed-1 >= floor {
+			return true
+		}
+	}
+	return false
+}
+
+// storeLatestLocked publishes snapshot as latest. The ring slot it replaces
+// is reused only after every reader that could have loaded it is gone.
+func (t *StateTree) storeLatestLocked(snapshot *Snapshot) {
+	prev := t.versions.latestSlot
+	t.versions.latest.Store(snapshot)
+	seq := t.versions.publishSeq.Add(1)
+	if prev >= 0 {
+		t.versions.ringRetired[prev] = seq
+	}
+	idx := int(snapshot.Version % SnapshotRingSize)
+	if snapshot == &t.versions.snapshotRing[idx] {
+		t.versions.latestSlot = idx
+	} else {
+		t.versions.latestSlot = -1
+	}
+}
+
+// writableSnapshotSlot returns the version's ring slot unless it is the
+// current latest or a reader that loaded its previous contents may still
+// hold it; then the snapshot goes to the heap.
 func (t *StateTree) writableSnapshotSlot(version uint64) *Snapshot {
-	if t.versions.activeReaders.Load() > 0 {
+	idx := int(version % SnapshotRingSize)
+	slot := &t.versions.snapshotRing[idx]
+	if idx == t.versions.latestSlot || t.readerBlocksLocked(t.versions.ringRetired[idx], slot.Version) {
 		return &Snapshot{}
 	}
-	return &t.versions.snapshotRing[version%SnapshotRingSize]
+	return slot
 }
 
-func (t *StateTree) reclaimLocked() {
-	if t.versions.activeReaders.Load() > 0 {
-		return
+// countVersionLocked adds a committed version to its epoch's refcount.
+func (t *StateTree) countVersionLocked(epochID uint64, version uint64) {
+	if floor, ok := t.versions.epochFloor[epochID]; !ok || version < floor {
+		t.versions.epochFloor[epochID] = version
 	}
+	t.versions.epochRefcount[epochID]++
+}
+
+// reclaimLocked prunes versions outside the retention window, retires the
+// epochs left without versions once no retained tree shares their nodes,
+// compacts the pinned ones when enough have piled up and recycles the
+// retired epochs that no open reader can still reach.
+func (t *StateTree) reclaimLocked() {
 	latest := t.versions.latest.Load()
-	if latest == nil {
-		return
+	if latest != nil {
+		minKeep := uint64(0)
+		if latest.Version > t.versions.retainVersions {
+			minKeep = latest.Version - t.versions.retainVersions
+		}
+		t.versions.rootsMu.Lock()
+		for version, ref := range t.versions.versionRoots {
+			if version == 0 || version >= minKeep || t.versions.pinned[version] > 0 {
+				continue
+			}
+			delete(t.versions.versionRoots, version)
+			if cnt, ok := t.versions.epochRefcount[ref.epochID]; ok {
+				cnt--
+				t.versions.epochRefcount[ref.epochID] = cnt
+				if cnt == 0 {
+					t.versions.orphanEpochs = append(t.versions.orphanEpochs, ref.epochID)
+				}
+			}
+		}
+		t.versions.rootsMu.Unlock()
 	}
 
-	minKeep := uint64(0)
-	if latest.Version > t.versions.retainVersions {
-		minKeep = latest.Version - t.versions.retainVersions
+	if len(t.versions.orphanEpochs) > t.versions.orphansChecked {
+		t.retireUnreachableLocked()
+		if len(t.versions.orphanEpochs) >= t.versions.compactAt {
+			// 압축하지 못한 epoch은 그대로 남으므로 다음 시도는 그만큼 더 쌓인 뒤에 한다.
+			_, _ = t.compactLocked(time.Time{})
+			t.versions.compactAt = len(t.versions.orphanEpochs) + compactPinnedEpochs
+		}
 	}
 
-	for version := range t.versions.versionRoots {
-		if version == 0 || version >= minKeep {
+	kept := t.versions.retired[:0]
+	for _, r := range t.versions.retired {
+		if t.readerBlocksLocked(r.seq, r.floor) {
+			kept = append(kept, r)
 			continue
 		}
-		ref := t.versions.versionRoots[version]
-		delete(t.versions.versionRoots, version)
-		if cnt, ok := t.versions.epochRefcount[ref.epochID]; ok {
-			cnt--
-			t.versions.epochRefcount[ref.epochID] = cnt
-			if cnt == 0 {
-				t.recycleEpochLocked(ref.epochID)
-			}
+		if cnt, ok := t.versions.epochRefcount[r.epochID]; ok && cnt == 0 {
+			t.recycleEpochLocked(r.epochID)
 		}
 	}
+	t.versions.retired = kept
 }
 
 func (t *StateTree) recycleEpochLocked(epochID uint64) {
@@ -54,6 +199,7 @@ func (t *StateTree) recycleEpochLocked(epochID uint64) {
 	if epochID == 1 {
 		return
 	}
+	t.freeEpochIndicesLocked(epochID)
 	delete(t.memory.epochByID, epochID)
 	for i := len(t.memory.epochs) - 1; i >= 0; i-- {
 		if t.memory.epochs[i] != ep {
@@ -63,15 +209,7 @@ func (t *StateTree) recycleEpochLocked(epochID uint64) {
 		break
 	}
 	delete(t.versions.epochRefcount, epochID)
-	slotIdx := epochID % uint64(len(t.memory.epochRing))
-	if t.memory.epochRing[slotIdx].epochID.Load() == epochID {
-		t.memory.epochRing[slotIdx].epochID.Store(0)
-		t.memory.epochRing[slotIdx].arena.Store(nil)
-	}
-	if len(t.memory.warmPool) < t.memory.maxPoolSize {
-		_ = ep.ResetForReuse(0)
-		t.memory.warmPool = append(t.memory.warmPool, ep)
-	} else {
-		ep.Free()
-	}
+	delete(t.versions.epochFloor, epochID)
+	t.memory.epochRing[epochID%uint64(len(t.memory.epochRing))].unpublish(epochID)
+	t.memory.store.ReleaseEpoch(ep)
 }
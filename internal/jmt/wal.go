@@ -0,0 +1,720 @@
+//go:build goexperiment.arenas
+
+package jmt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The write-ahead log is a sequence of records, each framed as
+//
+//	len uint32 | crc32c(payload) uint32 | payload
+//
+// and every payload starts with kind, version and the version's root hash.
+// A batch payload then holds the normalized mutations; a rollback payload
+// nothing more; a promote payload the length-prefixed batch payloads of the
+// branch, which replace everything after version. A bulk load is split into
+// part records of about walBulkChunkSize, each holding its sequence number
+// and mutations, and ends with a bulk record numbered after the last part
+// and carrying the root; parts without their bulk record are ignored. A
+// record is written and, depending on Config.WALGroupSize, synced before its
+// version is published. A log rewritten by TruncateWAL starts with a base
+// record naming the checkpointed version it continues from.
+const (
+	walBatch byte = iota + 1
+	walBulk
+	walRollback
+	walPromote
+	walBulkPart
+	walBase
+)
+
+const (
+	walFrameSize  = 8
+	walHeaderSize = 1 + 8 + 32
+	// bulk load은 이 크기마다 part record로 끊어 쓴다.
+	walBulkChunkSize = 1 << 20
+)
+
+// Mutation flags.
+const (
+	walDelete byte = 1 << iota
+	walKV
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type wal struct {
+	file    *os.File
+	path    string
+	group   int
+	pending int
+	// size is where the next record starts.
+	size int64
+	// base is the version the log starts after; older versions are only in
+	// a checkpoint.
+	base uint64
+	// buf holds the payload being encoded and frame its header.
+	buf   []byte
+	frame [walFrameSize]byte
+}
+
+// write appends payload as one record and syncs the log once group records
+// are pending.
+func (w *wal) write(payload []byte) error {
+	if err := w.append(payload); err != nil {
+		return err
+	}
+	w.pending++
+	if w.pending < w.group {
+		return nil
+	}
+	w.pending = 0
+	return w.file.Sync()
+}
+
+// append writes payload as one record without counting it towards a sync.
+// A failed write is cut off again, so later records never follow a torn one.
+func (w *wal) append(payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return ErrWALRecordSize
+	}
+	binary.LittleEndian.PutUint32(w.frame[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(w.frame[4:], crc32.Checksum(payload, crc32cTable))
+	_, err := w.file.Write(w.frame[:])
+	if err == nil {
+		_, err = w.file.Write(payload)
+	}
+	if err != nil {
+		w.rewind(w.size)
+		return err
+	}
+	w.size += walFrameSize + int64(len(payload))
+	return nil
+}
+
+// rewind drops every record written after size. It is best effort: if the
+// file cannot be cut, Recover still stops at the torn tail.
+func (w *wal) rewind(size int64) {
+	if w.file.Truncate(size) == nil {
+		if _, err := w.file.Seek(size, io.SeekStart); err == nil {
+			w.size = size
+		}
+	}
+}
+
+func (w *wal) close() error {
+	if w == nil {
+		return nil
+	}
+	var err error
+	if w.pending > 0 {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func appendWALHeader(dst []byte, kind byte, version uint64, root [32]byte) []byte {
+	dst = append(dst, kind)
+	dst = binary.LittleEndian.AppendUint64(dst, version)
+	return append(dst, root[:]...)
+}
+
+// appendWALMutation encodes a normalized mutation. KV mutations keep their
+// original bytes; the hashed key and value are derived again on replay.
+func appendWALMutation(dst []byte, m *Mutation) []byte {
+	var flags byte
+	if m.Delete {
+		flags |= walDelete
+	}
+	if m.raw != nil {
+		flags |= walKV
+	}
+	dst = append(dst, flags)
+	if m.raw == nil {
+		dst = append(dst, m.Key[:]...)
+		if !m.Delete {
+			dst = append(dst, m.Value[:]...)
+		}
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(m.raw.Key)))
+	dst = append(dst, m.raw.Key...)
+	if !m.Delete {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(m.raw.Value)))
+		dst = append(dst, m.raw.Value...)
+	}
+	return dst
+}
+
+func appendWALBatch(dst []byte, version uint64, root [32]byte, mutations []Mutation) []byte {
+	dst = appendWALHeader(dst, walBatch, version, root)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(mutations)))
+	for i := range mutations {
+		dst = appendWALMutation(dst, &mutations[i])
+	}
+	return dst
+}
+
+// logLocked writes the payload in t.wal.buf. Callers publish only if it
+// succeeds.
+func (t *StateTree) logLocked() error {
+	return t.wal.write(t.wal.buf)
+}
+
+// logBatchLocked logs a batch committed on the main head.
+func (t *StateTree) logBatchLocked(version uint64, root [32]byte, mutations []Mutation) error {
+	if t.wal == nil {
+		return nil
+	}
+	t.wal.buf = appendWALBatch(t.wal.buf[:0], version, root, mutations)
+	return t.logLocked()
+}
+
+// logRollbackLocked logs that version became the latest again.
+func (t *StateTree) logRollbackLocked(version uint64, root [32]byte) error {
+	if t.wal == nil {
+		return nil
+	}
+	t.wal.buf = appendWALHeader(t.wal.buf[:0], walRollback, version, root)
+	return t.logLocked()
+}
+
+// logPromoteLocked logs a promoted branch as one record, so that replay sees
+// either all of it or none.
+func (t *StateTree) logPromoteLocked(b *branch, baseRoot [32]byte) error {
+	if t.wal == nil {
+		return nil
+	}
+	buf := appendWALHeader(t.wal.buf[:0], walPromote, b.base, baseRoot)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b.log)))
+	for _, payload := range b.log {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = append(buf, payload...)
+	}
+	t.wal.buf = buf
+	return t.logLocked()
+}
+
+// TruncateWAL rewrites the write-ahead log to start at version, a retained
+// version of the main head, once a checkpoint of it is stored safely. The new
+// log holds a base record with version's root and then the records of every
+// later version, so Recover replays only what follows the checkpoint and
+// fails with ErrWALBase without it. Rollback and Promote to a version before
+// the base fail with ErrWALBase from then on. The log is written to a
+// temporary file and renamed over the old one, so a crash leaves either.
+func (t *StateTree) TruncateWAL(version uint64) error {
+	t.writerMu.Lock()
+	defer t.writerMu.Unlock()
+
+	w := t.wal
+	if w == nil {
+		return ErrNoWAL
+	}
+	if version < w.base {
+		return ErrWALBase
+	}
+	ref, ok := t.versions.versionRoots[version]
+	if !ok {
+		return ErrUnknownVersion
+	}
+	log, err := scanWAL(w.file)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := w.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	next := &wal{file: file, path: w.path, group: w.group, base: version}
+	if err := next.copyFrom(w, &log, version, ref.rootHash); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	next.buf = w.buf
+	_ = w.file.Close()
+	t.wal = next
+	return syncDir(filepath.Dir(w.path))
+}
+
+// copyFrom writes a base record for version and root, then every record of
+// log after version read from w, and syncs the result.
+func (next *wal) copyFrom(w *wal, log *walLog, version uint64, root [32]byte) error {
+	next.buf = appendWALHeader(nil, walBase, version, root)
+	if err := next.append(next.buf); err != nil {
+		return err
+	}
+	copyRecord := func(e *walEntry) error {
+		next.buf = slices.Grow(next.buf[:0], int(e.size))[:e.size]
+		if _, err := w.file.ReadAt(next.buf, e.off); err != nil {
+			return err
+		}
+		return next.append(next.buf)
+	}
+	for i := range log.history {
+		e := &log.history[i]
+		if e.version <= version {
+			continue
+		}
+		for j := range e.parts {
+			if err := copyRecord(&e.parts[j]); err != nil {
+				return err
+			}
+		}
+		if err := copyRecord(e); err != nil {
+			return err
+		}
+	}
+	return next.file.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// walEntry is one batch of the replayed history: payload bytes at off. A
+// bulk load also lists its part records and the number of entries in all.
+type walEntry struct {
+	off     int64
+	size    uint32
+	version uint64
+	parts   []walEntry
+	count   uint64
+}
+
+// walLog is what scanWAL finds in a log: the batches of the final history,
+// the base version and root the log continues from, and where its valid
+// records end.
+type walLog struct {
+	history  []walEntry
+	base     uint64
+	baseRoot [32]byte
+	end      int64
+}
+
+// Recover opens the write-ahead log at cfg.WALPath, creating it if needed,
+// and replays it into a new tree that keeps logging to it. Rolled back and
+// replaced versions are dropped first, so only the batches of the final
+// history are applied, and each must reproduce its logged version and root.
+// Replay stops at a last record that is cut short or fails its checksum, as
+// a crash during a write leaves it, and the log is truncated there. A bad
+// record followed by more data fails with ErrWALCorrupt and leaves the file
+// untouched.
+//
+// With checkpoints the tree is first loaded from them as by LoadCheckpoint,
+// and only the logged versions after the last one are replayed. A log
+// truncated by TruncateWAL needs a checkpoint at or after its base version,
+// and fails with ErrWALBase without one.
+func Recover(cfg Config, checkpoints ...io.Reader) (*StateTree, error) {
+	if cfg.WALPath == "" {
+		return nil, ErrNoWAL
+	}
+	file, err := os.OpenFile(cfg.WALPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	log, err := scanWAL(file)
+	if err == nil {
+		err = file.Truncate(log.end)
+	}
+	if err == nil {
+		_, err = file.Seek(log.end, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	var t *StateTree
+	if len(checkpoints) > 0 {
+		t, err = loadCheckpoint(checkpoints[0], cfg, checkpoints[1:])
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	} else {
+		t = newStateTree(cfg)
+	}
+	if err := t.replayWAL(file, &log); err != nil {
+		t.Close()
+		_ = file.Close()
+		return nil, err
+	}
+	t.writerMu.Lock()
+	t.wal = &wal{file: file, path: cfg.WALPath, group: max(cfg.WALGroupSize, 1), size: log.end, base: log.base}
+	t.writerMu.Unlock()
+	return t, nil
+}
+
+// scanWAL reads the record frames and builds the history of batches that
+// survive rollbacks and promotes.
+func scanWAL(file *os.File) (walLog, error) {
+	var log walLog
+	info, err := file.Stat()
+	if err != nil {
+		return log, err
+	}
+	var (
+		history []walEntry
+		parts   []walEntry
+		frame   [walFrameSize]byte
+		payload []byte
+		off     int64
+	)
+	done := func() (walLog, error) {
+		log.history, log.end = history, off
+		return log, nil
+	}
+	for {
+		if _, err := file.ReadAt(frame[:], off); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return done()
+			}
+			return log, err
+		}
+		size := binary.LittleEndian.Uint32(frame[0:])
+		if off+walFrameSize+int64(size) > info.Size() {
+			// 쓰다 만 마지막 기록이거나 length가 망가진 기록이다. 뒤에 온전한 기록이
+			// 하나라도 있으면 끝이 아니므로 잘라 내지 않고 실패한다.
+			valid, err := recordAfter(file, off, info.Size())
+			if err != nil {
+				return log, err
+			}
+			if valid {
+				return log, fmt.Errorf("record length at offset %d: %w", off, ErrWALCorrupt)
+			}
+			return done()
+		}
+		payload = slices.Grow(payload[:0], int(size))[:size]
+		if _, err := file.ReadAt(payload, off+walFrameSize); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return done()
+			}
+			return log, err
+		}
+		if size < walHeaderSize || crc32.Checksum(payload, crc32cTable) != binary.LittleEndian.Uint32(frame[4:]) {
+			// 쓰다 만 기록은 로그의 끝에만 있을 수 있다. 뒤에 다른 기록이 있으면 손상이다.
+			if off+walFrameSize+int64(size) == info.Size() {
+				return done()
+			}
+			zero, err := zeroFrom(file, off, info.Size())
+			if err != nil {
+				return log, err
+			}
+			if zero {
+				return done()
+			}
+			return log, fmt.Errorf("record at offset %d: %w", off, ErrWALCorrupt)
+		}
+
+		base := off + walFrameSize
+		kind, version := payload[0], binary.LittleEndian.Uint64(payload[1:])
+		if kind != walBulkPart && kind != walBulk {
+			parts = parts[:0]
+		}
+		switch kind {
+		case walBatch:
+			history = append(history, walEntry{off: base, size: size, version: version})
+		case walBulkPart, walBulk:
+			// seq 0은 새 bulk load의 시작이다. 앞서 실패해 끝나지 못한 part는 버린다.
+			r := walReader{buf: payload, pos: walHeaderSize}
+			seq, n := r.uint32(), r.uint32()
+			if seq == 0 {
+				parts = parts[:0]
+			}
+			if r.err != nil || int(seq) != len(parts) || (seq > 0 && parts[0].version != version) {
+				return log, ErrWALCorrupt
+			}
+			entry := walEntry{off: base, size: size, version: version, count: uint64(n)}
+			if kind == walBulkPart {
+				parts = append(parts, entry)
+				break
+			}
+			for _, part := range parts {
+				entry.count += part.count
+			}
+			entry.parts = slices.Clone(parts)
+			parts = parts[:0]
+			history = append(history, entry)
+		case walBase:
+			// TruncateWAL이 쓴 base 기록은 로그의 맨 앞에만 온다.
+			if off != 0 {
+				return log, ErrWALCorrupt
+			}
+			log.base = version
+			copy(log.baseRoot[:], payload[9:walHeaderSize])
+		case walRollback:
+			if version < log.base {
+				return log, ErrWALCorrupt
+			}
+			history = truncateHistory(history, version)
+		case walPromote:
+			if version < log.base {
+				return log, ErrWALCorrupt
+			}
+			history = truncateHistory(history, version)
+			r := walReader{buf: payload, pos: walHeaderSize}
+			n := r.uint32()
+			for i := uint32(0); i < n && r.err == nil; i++ {
+				inner := r.uint32()
+				start := r.pos
+				r.bytes(int(inner))
+				if r.err == nil && inner >= walHeaderSize {
+					history = append(history, walEntry{off: base + int64(start), size: inner, version: binary.LittleEndian.Uint64(payload[start+1:])})
+				}
+			}
+			if r.err != nil {
+				return log, ErrWALCorrupt
+			}
+		default:
+			return log, ErrWALCorrupt
+		}
+		off = base + int64(size)
+	}
+}
+
+// zeroFrom reports whether the file holds only zero bytes from off to end,
+// as a file system may leave after a crash that extended the file.
+func zeroFrom(file *os.File, off, end int64) (bool, error) {
+	var buf [4096]byte
+	for off < end {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), end-off)], off)
+		if n == 0 && err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+	}
+	return true, nil
+}
+
+// recordAfter reports whether a frame with a matching checksum starts
+// anywhere in (off, end). A torn tail holds only part of one payload, so
+// finding a whole record behind off means the record at off is corrupt.
+func recordAfter(file *os.File, off, end int64) (bool, error) {
+	var (
+		window  [64 << 10]byte
+		start   int64
+		n       int
+		payload []byte
+	)
+	for pos := off + 1; pos+walFrameSize+walHeaderSize <= end; pos++ {
+		if pos+walFrameSize > start+int64(n) {
+			start = pos
+			var err error
+			n, err = file.ReadAt(window[:min(int64(len(window)), end-pos)], pos)
+			if n < walFrameSize {
+				return false, err
+			}
+		}
+		frame := window[pos-start:]
+		size := binary.LittleEndian.Uint32(frame[0:])
+		if size < walHeaderSize || pos+walFrameSize+int64(size) > end {
+			continue
+		}
+		payload = slices.Grow(payload[:0], int(size))[:size]
+		if _, err := file.ReadAt(payload, pos+walFrameSize); err != nil {
+			return false, err
+		}
+		if crc32.Checksum(payload, crc32cTable) == binary.LittleEndian.Uint32(frame[4:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func truncateHistory(history []walEntry, version uint64) []walEntry {
+	for len(history) > 0 && history[len(history)-1].version > version {
+		history = history[:len(history)-1]
+	}
+	return history
+}
+
+// replayWAL applies the history's batches after the tree's latest version,
+// which is the log's base or a checkpoint at or after it.
+func (t *StateTree) replayWAL(file *os.File, log *walLog) error {
+	latest := t.LatestVersion()
+	if latest < log.base {
+		return fmt.Errorf("log starts after version %d, tree is at %d: %w", log.base, latest, ErrWALBase)
+	}
+	if latest == log.base && log.base != 0 && t.RootHash() != log.baseRoot {
+		return fmt.Errorf("replay base version %d: %w", log.base, ErrRootMismatch)
+	}
+	var payload []byte
+	for _, e := range log.history {
+		if e.version < latest {
+			continue
+		}
+		payload = slices.Grow(payload[:0], int(e.size))[:e.size]
+		if _, err := file.ReadAt(payload, e.off); err != nil {
+			return err
+		}
+		kind := payload[0]
+		var root [32]byte
+		copy(root[:], payload[9:walHeaderSize])
+		if e.version == latest {
+			// checkpoint에 이미 담긴 버전이다. 같은 상태인지만 확인한다.
+			if root != t.RootHash() {
+				return fmt.Errorf("replay version %d: %w", e.version, ErrRootMismatch)
+			}
+			continue
+		}
+
+		var (
+			snapshot Snapshot
+			err      error
+		)
+		if kind == walBulk {
+			snapshot, err = t.replayBulk(file, e, payload, root)
+		} else {
+			var mutations []Mutation
+			mutations, err = t.decodeWALBatch(payload, walHeaderSize)
+			if err == nil {
+				t.writerMu.Lock()
+				snapshot, err = t.applyBatchLocked(mutations)
+				t.writerMu.Unlock()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("replay version %d: %w", e.version, err)
+		}
+		if snapshot.Version != e.version || snapshot.RootHash != root {
+			return fmt.Errorf("replay version %d: %w", e.version, ErrRootMismatch)
+		}
+	}
+	return nil
+}
+
+// replayBulk streams a bulk load's part records, then the mutations of its
+// final record in payload, into BulkLoad.
+func (t *StateTree) replayBulk(file *os.File, e walEntry, payload []byte, root [32]byte) (Snapshot, error) {
+	var (
+		part     []byte
+		entryErr error
+	)
+	emit := func(yield func([32]byte, [32]byte) bool, payload []byte) bool {
+		mutations, err := t.decodeWALBatch(payload, walHeaderSize+4)
+		if err != nil {
+			entryErr = err
+			return false
+		}
+		for i := range mutations {
+			if !yield(mutations[i].Key, mutations[i].Value) {
+				return false
+			}
+		}
+		return true
+	}
+	snapshot, err := t.BulkLoad(func(yield func([32]byte, [32]byte) bool) {
+		for _, p := range e.parts {
+			part = slices.Grow(part[:0], int(p.size))[:p.size]
+			if _, err := file.ReadAt(part, p.off); err != nil {
+				entryErr = err
+				return
+			}
+			if !emit(yield, part) {
+				return
+			}
+		}
+		emit(yield, payload)
+	}, int(e.count), &root)
+	if entryErr != nil {
+		return Snapshot{}, entryErr
+	}
+	return snapshot, err
+}
+
+// decodeWALBatch decodes the mutations of a batch or bulk payload, whose
+// count sits at pos. KV mutations point into payload, which must outlive the
+// commit.
+func (t *StateTree) decodeWALBatch(payload []byte, pos int) ([]Mutation, error) {
+	r := walReader{buf: payload, pos: pos}
+	n := r.uint32()
+	mutations := make([]Mutation, 0, min(int(n), len(payload)))
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		flags := r.byte()
+		var m Mutation
+		m.Delete = flags&walDelete != 0
+		if flags&walKV == 0 {
+			copy(m.Key[:], r.bytes(32))
+			if !m.Delete {
+				copy(m.Value[:], r.bytes(32))
+			}
+		} else {
+			raw := &KVMutation{Delete: m.Delete}
+			raw.Key = r.bytes(int(r.uint32()))
+			m.Key = t.hasher.HashKey(raw.Key)
+			if !m.Delete {
+				raw.Value = r.bytes(int(r.uint32()))
+				m.Value = t.hasher.HashValue(raw.Value)
+			}
+			m.raw = raw
+		}
+		mutations = append(mutations, m)
+	}
+	if r.err != nil || r.pos != len(payload) {
+		return nil, ErrWALCorrupt
+	}
+	return mutations, nil
+}
+
+// walReader decodes a payload; the first out-of-range read sets err.
+type walReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *walReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf)-r.pos < n {
+		r.err = ErrWALCorrupt
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *walReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *walReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
@@ -2,9 +2,26 @@ package proof
 
 const TreeDepth = 256
 
+// MerkleProof는 key 경로를 root부터 Depth까지 따라간 결과다. leaf는 유일해지는
+// 가장 얕은 depth에 놓이므로 Siblings[:Depth]만 의미가 있다.
 type MerkleProof struct {
 	Version  uint64
 	Exists   bool
 	LeafHash [32]byte
+	// Value is the value of the leaf at the end of the path: the proven key's
+	// when Exists is set, otherwise the key that occupies its slot.
+	Value [32]byte
+	// LeafKey is the key of the leaf at the end of the path. It equals the
+	// proven key when Exists is set or when the path ends in an empty slot.
+	LeafKey [32]byte
+	// Key is the original variable-length key, nil for 32-byte keys.
+	Key []byte
+	// Depth is the number of siblings on the path.
+	Depth    uint16
 	Siblings [TreeDepth][32]byte
 }
+
+// Path returns the siblings from the root down to the proof's leaf or empty slot.
+func (p *MerkleProof) Path() [][32]byte {
+	return p.Siblings[:p.Depth]
+}
@@ -0,0 +1,70 @@
+package proof
+
+import "github.com/Pam-La/jmt_for_mac/internal/hash"
+
+// SparseLeaf is the leaf that ends a sparse proof's path.
+type SparseLeaf struct {
+	Key       [32]byte
+	ValueHash [32]byte
+}
+
+// SparseMerkleProof has the shape of the Aptos/Diem SparseMerkleProof: the
+// leaf at the end of the path, if any, and the siblings ordered from the
+// bottom of the path up to the root. Hashes match Aptos's when the tree is
+// built with hash.SchemeAptos, which uses its leaf/internal hasher seeds and
+// returns its placeholder from ZeroHash.
+type SparseMerkleProof struct {
+	Leaf     *SparseLeaf
+	Siblings [][32]byte
+}
+
+// Sparse converts p, a proof for key, to the bottom-up sparse layout.
+func (p *MerkleProof) Sparse(key [32]byte) SparseMerkleProof {
+	var out SparseMerkleProof
+	if p.Exists || p.LeafKey != key {
+		out.Leaf = &SparseLeaf{Key: p.LeafKey, ValueHash: p.Value}
+	}
+	out.Siblings = make([][32]byte, p.Depth)
+	for i := range out.Siblings {
+		out.Siblings[i] = p.Siblings[int(p.Depth)-1-i]
+	}
+	return out
+}
+
+// VerifySparse checks a sparse proof for key against expectedRoot. A nil
+// value checks non-membership; otherwise value is the leaf value (the value
+// hash for variable-length keys).
+func VerifySparse(engine hash.Hasher, expectedRoot [32]byte, key [32]byte, value *[32]byte, p SparseMerkleProof) bool {
+	depth := len(p.Siblings)
+	if depth > TreeDepth {
+		return false
+	}
+
+	var current [32]byte
+	switch {
+	case value != nil && p.Leaf != nil:
+		if p.Leaf.Key != key || p.Leaf.ValueHash != *value {
+			return false
+		}
+		current = engine.HashLeaf(p.Leaf.Key, p.Leaf.ValueHash)
+	case value != nil:
+		return false
+	case p.Leaf != nil:
+		// 다른 key의 leaf가 경로를 끝내면 그 서브트리에 key가 있을 수 없다.
+		if p.Leaf.Key == key || !samePrefix(p.Leaf.Key, key, uint16(depth)) {
+			return false
+		}
+		current = engine.HashLeaf(p.Leaf.Key, p.Leaf.ValueHash)
+	default:
+		current = engine.ZeroHash(uint16(depth))
+	}
+
+	for i, sibling := range p.Siblings {
+		if bitAt(key, uint16(depth-1-i)) == 0 {
+			current = engine.HashParent(current, sibling)
+		} else {
+			current = engine.HashParent(sibling, current)
+		}
+	}
+	return current == expectedRoot
+}
@@ -2,33 +2,63 @@ package proof
 
 import "github.com/Pam-La/jmt_for_mac/internal/hash"
 
-func Verify(engine *hash.Engine, key [32]byte, value [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
+// Verify checks proof for key against expectedRoot. A non-membership proof
+// either ends in an empty slot or in another leaf sharing key's first Depth
+// bits; in the latter case value is ignored and the occupant is checked.
+func Verify(engine hash.Hasher, key [32]byte, value [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
+	if proof.Depth > TreeDepth {
+		return false
+	}
 	if proof.Exists {
-		leafHash := engine.HashLeaf(&key, &value)
+		if proof.LeafKey != key {
+			return false
+		}
+		leafHash := engine.HashLeaf(key, value)
 		if leafHash != proof.LeafHash {
 			return false
 		}
 		return verifyFromLeaf(engine, key, leafHash, proof, expectedRoot)
 	}
-	return verifyFromLeaf(engine, key, engine.ZeroHash(256), proof, expectedRoot)
+	if proof.LeafKey == key {
+		return verifyFromLeaf(engine, key, engine.ZeroHash(proof.Depth), proof, expectedRoot)
+	}
+	if !samePrefix(proof.LeafKey, key, proof.Depth) {
+		return false
+	}
+	if engine.HashLeaf(proof.LeafKey, proof.Value) != proof.LeafHash {
+		return false
+	}
+	return verifyFromLeaf(engine, key, proof.LeafHash, proof, expectedRoot)
 }
 
-func VerifyLeafHash(engine *hash.Engine, key [32]byte, leafHash [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
+// VerifyBytes checks a proof for a variable-length key against value. The
+// path is recomputed from proof.Key; value is ignored for non-membership.
+func VerifyBytes(engine hash.Hasher, value []byte, proof MerkleProof, expectedRoot [32]byte) bool {
+	if proof.Key == nil {
+		return false
+	}
+	return Verify(engine, engine.HashKey(proof.Key), engine.HashValue(value), proof, expectedRoot)
+}
+
+func VerifyLeafHash(engine hash.Hasher, key [32]byte, leafHash [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
+	if proof.Depth > TreeDepth {
+		return false
+	}
 	if proof.Exists && leafHash != proof.LeafHash {
 		return false
 	}
 	return verifyFromLeaf(engine, key, leafHash, proof, expectedRoot)
 }
 
-func verifyFromLeaf(engine *hash.Engine, key [32]byte, leafHash [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
+func verifyFromLeaf(engine hash.Hasher, key [32]byte, leafHash [32]byte, proof MerkleProof, expectedRoot [32]byte) bool {
 	current := leafHash
-	for depth := TreeDepth - 1; depth >= 0; depth-- {
+	for depth := int(proof.Depth) - 1; depth >= 0; depth-- {
 		sibling := proof.Siblings[depth]
 		bit := bitAt(key, uint16(depth))
 		if bit == 0 {
-			current = engine.HashParent(&current, &sibling)
+			current = engine.HashParent(current, sibling)
 		} else {
-			current = engine.HashParent(&sibling, &current)
+			current = engine.HashParent(sibling, current)
 		}
 	}
 	return current == expectedRoot
@@ -39,3 +69,19 @@ func bitAt(key [32]byte, depth uint16) uint8 {
 	bitOffset := 7 - (depth % 8)
 	return (key[byteIndex] >> bitOffset) & 1
 }
+
+// samePrefix reports whether a and b agree on their first depth bits.
+func samePrefix(a [32]byte, b [32]byte, depth uint16) bool {
+	full := int(depth / 8)
+	for i := 0; i < full; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	rem := depth % 8
+	if rem == 0 {
+		return true
+	}
+	mask := byte(0xFF << (8 - rem))
+	return a[full]&mask == b[full]&mask
+}